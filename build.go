@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BertoldVdb/jms578flash/image"
+)
+
+func runBuild(input string, loadAddr string, nvramFile string, isRam bool, firmware string) {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		log.Fatalln("Failed to read code:", err)
+	}
+
+	var code []byte
+	switch strings.ToLower(filepath.Ext(input)) {
+	case ".hex", ".ihx":
+		code, err = image.CodeFromHex(data)
+	default:
+		var addr uint64
+		addr, err = strconv.ParseUint(loadAddr, 0, 16)
+		if err != nil {
+			log.Fatalln("Invalid load address:", err)
+		}
+		code, err = image.CodeFromBinary(data, uint32(addr))
+	}
+	if err != nil {
+		log.Fatalln("Failed to load code:", err)
+	}
+
+	nvram, err := readFile(nvramFile)
+	if err != nil {
+		log.Fatalln("Failed to read NVRAM:", err)
+	}
+	if nvram != nil && isRam {
+		log.Fatalln("A RAM image cannot contain NVRAM")
+	}
+	if len(nvram) > image.NVRAMSize {
+		log.Fatalln("NVRAM is too large")
+	}
+
+	fw := image.Build(code, nvram, isRam)
+	if err := os.WriteFile(firmware, fw, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Printf("%d bytes of code (%04x-%04x) written to %s", len(code), image.CodeAddress, image.CodeAddress+len(code), firmware)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/BertoldVdb/jms578flash/jmshal"
+	"github.com/BertoldVdb/jms578flash/scsi"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+)
+
+func loadChipDatabase(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	err := spiflash.LoadDatabase(path)
+
+	/* It is fine if the default database does not exist */
+	if errors.Is(err, fs.ErrNotExist) && path == spiflash.DefaultDatabasePath() {
+		return nil
+	}
+	return err
+}
+
+func printChip(w *tabwriter.Writer, d spiflash.DeviceInfo) {
+	id := fmt.Sprintf("%x", d.ID)
+	if d.Mask != 0 {
+		id += fmt.Sprintf("/%x", d.Mask)
+	}
+
+	fmt.Fprintf(w, "%s\t%s\t%dk\t%d\t%02x\t%02x/%d\t%02x/%d\t%s\n", id, d.Name, d.ChipSize/1024, d.PageSize,
+		d.OpcodeChipErase, d.OpcodeBlockErase, d.BlockSize, d.OpcodePageErase, d.PageEraseSize, d.Source)
+}
+
+func runChips(dev string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tName\tSize\tPage\tChip erase\tBlock erase\tPage erase\tSource")
+	for _, m := range spiflash.Devices() {
+		printChip(w, m)
+	}
+	w.Flush()
+
+	sdev, err := scsi.New(dev)
+	if err != nil {
+		log.Println("Not showing matching chip:", err)
+		return
+	}
+
+	jms, err := jmshal.New(sdev, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	flash, err := jms.FlashOpen()
+	if err != nil {
+		log.Fatalln("Failed to identify flash:", err)
+	}
+
+	id := flash.DeviceID()
+	fmt.Printf("\nDevice has flash with JEDEC ID %x, it matches:\n", id[:])
+	printChip(w, flash.Device())
+	w.Flush()
+
+	for _, m := range flash.Warnings() {
+		fmt.Println("Warning:", m)
+	}
+
+	/* Only chips that are not in the table are configured using SFDP, check the others here */
+	if flash.Device().Source != "SFDP" {
+		diff, err := flash.CheckSFDP()
+		if err != nil && err != spiflash.ErrorNoSFDP {
+			fmt.Println("Warning: failed to read SFDP:", err)
+		}
+		for _, m := range diff {
+			fmt.Println("Warning:", m)
+		}
+	}
+}
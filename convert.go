@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/BertoldVdb/jms578flash/image"
+)
+
+func runConvert(firmware string, output string, toRam bool, nvramFile string, dropNVRAM bool) {
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	nvram, err := readFile(nvramFile)
+	if err != nil {
+		log.Fatalln("Failed to read NVRAM:", err)
+	}
+
+	var result []byte
+	if toRam {
+		if nvram != nil {
+			log.Fatalln("A RAM image cannot contain NVRAM")
+		}
+		result, err = image.ConvertToRAM(fw, dropNVRAM)
+		if err == image.ErrorNVRAMNotEmpty {
+			log.Fatalln("The firmware contains NVRAM data, use '-dropnvram' to discard it")
+		}
+	} else {
+		result, err = image.ConvertToFlash(fw, nvram)
+	}
+	if err != nil {
+		log.Fatalln("Failed to convert firmware:", err)
+	}
+
+	if err := os.WriteFile(output, result, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Println(len(result), "bytes written to", output)
+}
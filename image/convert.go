@@ -0,0 +1,84 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrorNVRAMNotEmpty = errors.New("image contains NVRAM data, which does not fit in a RAM image")
+
+/* convertHeader copies the header and code of an image and changes the type. The metadata
+ * block at 0x200 is only used in flash images, the vendor RAM images leave it erased. */
+func convertHeader(fw []byte, isRam bool) []byte {
+	out := make([]byte, 0xC400)
+	copy(out, fw[:0xC400])
+
+	if isRam {
+		binary.BigEndian.PutUint32(out[6:], typeMagicRAM)
+	} else {
+		binary.BigEndian.PutUint32(out[6:], typeMagicFlash)
+
+		/* Only RAM images store a checksum here */
+		binary.BigEndian.PutUint32(out[0x1f8:], 0)
+	}
+
+	for i := 0x200; i < 0x400; i++ {
+		out[i] = 0xff
+	}
+	if !isRam {
+		binary.BigEndian.PutUint32(out[0x200:], 0x5ac369e1)
+	}
+
+	return out
+}
+
+/* ConvertToRAM turns a valid image into a RAM image that can be loaded with the vendor command.
+ * The header, version and code are kept. RAM images have no NVRAM, if the image contains
+ * NVRAM data it is only dropped when dropNVRAM is set. */
+func ConvertToRAM(fw []byte, dropNVRAM bool) ([]byte, error) {
+	_, nvram, _, err := Extract(fw)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dropNVRAM {
+		for _, m := range nvram {
+			if m != 0xff {
+				return nil, ErrorNVRAMNotEmpty
+			}
+		}
+	}
+
+	out := convertHeader(fw, true)
+	ChecksumUpdate(out, true)
+
+	return out, nil
+}
+
+/* ConvertToFlash turns a valid image into a flash image. The header, version and code are kept.
+ * If nvram is nil, the NVRAM of a flash image is kept, otherwise the image gets an erased NVRAM. */
+func ConvertToFlash(fw []byte, nvram []byte) ([]byte, error) {
+	_, oldNVRAM, isRam, err := Extract(fw)
+	if err != nil {
+		return nil, err
+	}
+
+	if nvram == nil && !isRam && len(oldNVRAM) > 0 {
+		nvram = oldNVRAM
+	}
+	if nvram == nil {
+		nvram = make([]byte, 0x200)
+		for i := range nvram {
+			nvram[i] = 0xff
+		}
+	}
+
+	if len(nvram) != NVRAMSize {
+		return nil, ErrorInvalidLength
+	}
+
+	out := convertHeader(fw, false)
+	ChecksumUpdate(out, false)
+
+	return append(out, nvram...), nil
+}
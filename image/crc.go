@@ -1,8 +1,6 @@
 package image
 
 import (
-	"encoding/binary"
-
 	"github.com/snksoft/crc"
 )
 
@@ -34,20 +32,7 @@ func crcCalculateBlock(data []byte) uint32 {
 	return h.CRC32()
 }
 
-func crcWriteCheck(slice []byte, value uint32, valid bool, doWrite bool) bool {
-	if len(slice) < 4 {
-		panic("slice length invalid")
-	}
-
-	orig := binary.BigEndian.Uint32(slice)
-	if doWrite {
-		binary.BigEndian.PutUint32(slice, value)
-	}
-	return orig == value && valid
-}
-
-func crcCalculateAndWriteCheck(block []byte, valid bool, doWrite bool) bool {
-	crc := crcCalculateBlock(block[:len(block)-4])
-
-	return crcWriteCheck(block[len(block)-4:], crc, valid, doWrite)
+/* CRC returns the checksum used in the image, the length of data must be a multiple of 4 */
+func CRC(data []byte) uint32 {
+	return crcCalculateBlock(data)
 }
@@ -0,0 +1,127 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	/* The firmware code is mapped at this address, below it is the bootrom */
+	CodeAddress = 0x4000
+
+	/* Space for code in an image, it is followed by two checksums */
+	CodeSize = 0xC000 - 8
+)
+
+var (
+	ErrorCodeTooLarge = errors.New("code does not fit in the image")
+	ErrorCodeAddress  = errors.New("code is outside the firmware area")
+	ErrorCodeOverlap  = errors.New("code overlaps an earlier record")
+)
+
+/* codePlace copies data to a code buffer, growing it as needed. Unused bytes are erased. */
+func codePlace(code []byte, addr uint32, data []byte) ([]byte, error) {
+	if addr < CodeAddress {
+		return nil, ErrorCodeAddress
+	}
+
+	offset := int(addr - CodeAddress)
+	end := offset + len(data)
+	if end > CodeSize {
+		return nil, ErrorCodeTooLarge
+	}
+
+	for len(code) < end {
+		code = append(code, 0xff)
+	}
+	copy(code[offset:], data)
+
+	return code, nil
+}
+
+/* CodeFromBinary returns the code buffer for a raw binary that is loaded at loadAddr */
+func CodeFromBinary(bin []byte, loadAddr uint32) ([]byte, error) {
+	return codePlace(nil, loadAddr, bin)
+}
+
+/* CodeFromHex returns the code buffer for an Intel HEX file, as created by SDCC (.ihx) or Keil */
+func CodeFromHex(ihex []byte) ([]byte, error) {
+	var code []byte
+	var base uint32
+
+	/* Records that overwrite each other point to a problem in the link map */
+	written := make([]bool, CodeSize)
+
+	scanner := bufio.NewScanner(bytes.NewReader(ihex))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		fail := func(msg string) error {
+			return fmt.Errorf("hex line %d: %s", line, msg)
+		}
+
+		if text[0] != ':' {
+			return nil, fail("missing start code")
+		}
+		record, err := hex.DecodeString(text[1:])
+		if err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fail("invalid record")
+		}
+
+		sum := byte(0)
+		for _, m := range record {
+			sum += m
+		}
+		if sum != 0 {
+			return nil, fail("wrong checksum")
+		}
+
+		addr := uint32(record[1])<<8 | uint32(record[2])
+		data := record[4 : len(record)-1]
+
+		switch record[3] {
+		case 0x00:
+			code, err = codePlace(code, base+addr, data)
+			if err != nil {
+				return nil, fmt.Errorf("hex line %d: %w", line, err)
+			}
+
+			offset := int(base + addr - CodeAddress)
+			for i := offset; i < offset+len(data); i++ {
+				if written[i] {
+					return nil, fmt.Errorf("hex line %d: %w at %04x", line, ErrorCodeOverlap, i+CodeAddress)
+				}
+				written[i] = true
+			}
+		case 0x01:
+			return code, nil
+		case 0x02:
+			if len(data) != 2 {
+				return nil, fail("invalid segment address")
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case 0x04:
+			if len(data) != 2 {
+				return nil, fail("invalid linear address")
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case 0x03, 0x05:
+			/* Start address, the bootrom always starts the code at the same place */
+		default:
+			return nil, fail("unknown record type")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("hex file has no end record")
+}
@@ -10,36 +10,71 @@ func makeHeader(fw []byte, isRam bool) {
 	/* Write header in block 0 */
 	fw[0] = 1
 	fw[1] = 0
-	binary.BigEndian.PutUint32(fw[2:], 0x152d0579)
+	binary.BigEndian.PutUint32(fw[2:], headerMagic)
 
 	if isRam {
-		binary.BigEndian.PutUint32(fw[6:], 0x04040606)
+		binary.BigEndian.PutUint32(fw[6:], typeMagicRAM)
 	} else {
-		binary.BigEndian.PutUint32(fw[6:], 0x03030505)
+		binary.BigEndian.PutUint32(fw[6:], typeMagicFlash)
 	}
 
 	copy(fw[10:], []byte("JMicron JMS579"))
 }
 
-func checksumInternal(input []byte, isRam bool, doWrite bool) bool {
-	wasValid := true
+/* A CRCField is one of the checksums in an image */
+type CRCField struct {
+	Name string
+
+	/* Where the checksum is stored */
+	Offset int
+
+	Stored     uint32
+	Calculated uint32
+}
+
+func (c CRCField) Valid() bool {
+	return c.Stored == c.Calculated
+}
+
+/* checksumFields calculates every checksum of the image. When doWrite is set, every
+ * checksum is updated before the next one is calculated. */
+func checksumFields(input []byte, isRam bool, doWrite bool) []CRCField {
+	var fields []CRCField
+
+	field := func(name string, offset int, value uint32) {
+		fields = append(fields, CRCField{
+			Name:       name,
+			Offset:     offset,
+			Stored:     binary.BigEndian.Uint32(input[offset:]),
+			Calculated: value,
+		})
+
+		if doWrite {
+			binary.BigEndian.PutUint32(input[offset:], value)
+		}
+	}
+
+	/* The checksum of a block is stored in its last 4 bytes */
+	block := func(name string, start int, end int) {
+		field(name, end-4, crcCalculateBlock(input[start:end-4]))
+	}
 
 	/* Fix metadata block 1 */
 	if isRam {
-		wasValid = crcCalculateAndWriteCheck(input[0:0x200-4], wasValid, doWrite)
+		block("header (RAM)", 0, 0x200-4)
 	}
-	wasValid = crcCalculateAndWriteCheck(input[0:0x200], wasValid, doWrite)
+	block("header", 0, 0x200)
 
 	/* Fix firmware CRC */
-	wasValid = crcCalculateAndWriteCheck(input[0x400:0xC400-4], wasValid, doWrite)
+	block("code", 0x400, 0xC400-4)
 
 	if isRam {
 		/* Write metadata CRC */
-		wasValid = crcCalculateAndWriteCheck(input[:0x400], wasValid, doWrite)
+		block("metadata", 0, 0x400)
 
 		/* Write full file CRC */
-		wasValid = crcCalculateAndWriteCheck(input[:0xC400], wasValid, doWrite)
-		return wasValid
+		block("image", 0, 0xC400)
+		return fields
 	}
 
 	/* Zero out metadata block 2 to compute full CRC */
@@ -55,12 +90,20 @@ func checksumInternal(input []byte, isRam bool, doWrite bool) bool {
 	fullCRC ^= uint32(0x7da476e9)
 
 	/* Write full CRC at end of file */
-	wasValid = crcWriteCheck(input[0xC400-4:], fullCRC, wasValid, doWrite)
+	field("image", 0xC400-4, fullCRC)
 
 	/* Fill in metadata block 2 */
-	wasValid = crcWriteCheck(input[0x208:], fullCRC, wasValid, doWrite)
-	wasValid = crcCalculateAndWriteCheck(input[0:0x400], wasValid, doWrite)
+	field("image (metadata copy)", 0x208, fullCRC)
+	block("metadata", 0, 0x400)
 
+	return fields
+}
+
+func checksumInternal(input []byte, isRam bool, doWrite bool) bool {
+	wasValid := true
+	for _, m := range checksumFields(input, isRam, doWrite) {
+		wasValid = wasValid && m.Valid()
+	}
 	return wasValid
 }
 
@@ -68,6 +111,26 @@ func ChecksumUpdate(input []byte, isRam bool) bool {
 	return checksumInternal(input, isRam, true)
 }
 
+/* ChecksumRepair recalculates the checksums of an image in place, using the layout given by
+ * its type magic. Only the checksum fields are changed. For each field, Stored is the old
+ * value and Calculated the value that was written. */
+func ChecksumRepair(image []byte) ([]CRCField, error) {
+	if len(image) < 0xC400 {
+		return nil, ErrorInvalidLength
+	}
+
+	var isRam bool
+	switch binary.BigEndian.Uint32(image[6:]) {
+	case typeMagicFlash:
+	case typeMagicRAM:
+		isRam = true
+	default:
+		return nil, ErrorInvalidHeader
+	}
+
+	return checksumFields(image, isRam, true), nil
+}
+
 var (
 	ErrorInvalidLength = errors.New("image length not valid")
 	ErrorInvalidHeader = errors.New("header is not valid")
@@ -96,10 +159,13 @@ func Validate(image []byte, isRam bool) error {
 	return nil
 }
 
+/* Size of the NVRAM block that follows the code in a flash image */
+const NVRAMSize = 0x200
+
 func Build(code []byte, nvram []byte, isRam bool) []byte {
 	length := 0xc400
 	if !isRam {
-		length += 0x200
+		length += NVRAMSize
 	}
 
 	fw := make([]byte, length)
@@ -116,7 +182,7 @@ func Build(code []byte, nvram []byte, isRam bool) []byte {
 	/* Write magic in block 1 */
 	binary.BigEndian.PutUint32(fw[0x200:], 0x5ac369e1)
 
-	if copy(fw[0x400:0xc400-8], code) < len(code) {
+	if copy(fw[0x400:0x400+CodeSize], code) < len(code) {
 		panic("code buffer too long")
 	}
 
@@ -136,10 +202,10 @@ func Extract(image []byte) ([]byte, []byte, bool, error) {
 		return nil, nil, false, ErrorInvalidLength
 	}
 
-	isRam := binary.BigEndian.Uint32(image[6:]) == 0x04040606
+	isRam := binary.BigEndian.Uint32(image[6:]) == typeMagicRAM
 	if err := Validate(image, isRam); err != nil {
 		return nil, nil, isRam, err
 	}
 
-	return image[0x400 : 0xC400-8], image[0xC400:], isRam, nil
+	return image[0x400 : 0x400+CodeSize], image[0xC400:], isRam, nil
 }
@@ -3,6 +3,10 @@ package image
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"testing"
 )
@@ -34,6 +38,10 @@ func testImage(t *testing.T, path string, isRam bool) {
 		t.Error("Image with invalid header:", err)
 	}
 
+	if err := Validate(append(c, make([]byte, 0x200)...), isRam); err != ErrorInvalidLength {
+		t.Error("Image with invalid length:", err)
+	}
+
 	buf[4]++
 	if err := Validate(buf, isRam); err != ErrorInvalidHeader {
 		t.Error("Image with invalid header:", err)
@@ -101,3 +109,262 @@ func TestBuildExtract(t *testing.T) {
 	testBuildExtract(t, false)
 	testBuildExtract(t, true)
 }
+
+func TestRaw(t *testing.T) {
+	code := getRandomBuf(0xc000 - 8)
+	nvram := getRandomBuf(0x200)
+	fw := Build(code, nvram, false)
+
+	if _, err := DefaultFlashLayout.RawBuild(fw, 0x8000); err != ErrorChipTooSmall {
+		t.Error("Image accepted for too small chip:", err)
+	}
+
+	raw, err := DefaultFlashLayout.RawBuild(fw, 0x10000)
+	if err != nil {
+		t.Fatal("Failed to build raw image:", err)
+	}
+
+	if len(raw) != 0x10000 || raw[0xfff0] != 0xff || raw[0x400] != 0xff {
+		t.Error("Unused flash is not erased")
+	}
+
+	fw2, err := DefaultFlashLayout.RawExtract(raw)
+	if err != nil {
+		t.Fatal("Failed to extract raw image:", err)
+	}
+
+	if !bytes.Equal(fw, fw2) {
+		t.Error("Extracted image is not equal to the input")
+	}
+
+	raw[0x1000]++
+	if _, err := DefaultFlashLayout.RawExtract(raw); err == nil {
+		t.Error("Corrupted raw image accepted")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	fw := Build(getRandomBuf(0xc000-8), nil, false)
+
+	info, err := Inspect(fw)
+	if err != nil {
+		t.Fatal("Failed to inspect image:", err)
+	}
+	if info.IsRam || !info.HeaderValid || !info.CRCValid() || len(info.CRCs) != 5 || info.Version != "0103" {
+		t.Errorf("Wrong information for valid image: %+v", info)
+	}
+
+	/* Only the code checksum and the ones covering the whole image should be wrong */
+	fw[0x1000]++
+	info, _ = Inspect(fw)
+	for _, m := range info.CRCs {
+		expectValid := m.Name == "header" || m.Name == "metadata"
+		if m.Valid() != expectValid {
+			t.Errorf("Wrong state for CRC %s: %08x/%08x", m.Name, m.Stored, m.Calculated)
+		}
+	}
+}
+
+func TestChecksumRepair(t *testing.T) {
+	for _, isRam := range []bool{false, true} {
+		orig := Build(getRandomBuf(0xc000-8), nil, isRam)
+
+		fw := make([]byte, len(orig))
+		copy(fw, orig)
+		fw[0x20]++
+		fw[0x2000]++
+		if Validate(fw, isRam) == nil {
+			t.Fatal("Modified image is still valid")
+		}
+
+		fields, err := ChecksumRepair(fw)
+		if err != nil {
+			t.Fatal("Failed to repair image:", err)
+		}
+		if err := Validate(fw, isRam); err != nil {
+			t.Error("Repaired image is not valid:", err)
+		}
+
+		/* Only the checksums may have changed */
+		for _, m := range fields {
+			copy(fw[m.Offset:m.Offset+4], orig[m.Offset:m.Offset+4])
+		}
+		fw[0x20]--
+		fw[0x2000]--
+		if !bytes.Equal(fw, orig) {
+			t.Error("Repair changed more than the checksums")
+		}
+	}
+
+	if _, err := ChecksumRepair(make([]byte, 0xc400)); err != ErrorInvalidHeader {
+		t.Error("Image without header accepted:", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	flash, err1 := ioutil.ReadFile("test/image_flash.bin")
+	ram, err2 := ioutil.ReadFile("test/image_ram.bin")
+	if err1 != nil || err2 != nil {
+		t.Log("Test images not found, skipping test")
+		return
+	}
+
+	/* The vendor images contain the same firmware */
+	if out, err := ConvertToRAM(flash, false); err != nil || !bytes.Equal(out, ram) {
+		t.Error("Wrong RAM image generated:", err)
+	}
+
+	if out, err := ConvertToFlash(ram, nil); err != nil || !bytes.Equal(out, flash) {
+		t.Error("Wrong flash image generated:", err)
+	}
+
+	nvram := getRandomBuf(0x200)
+	out, err := ConvertToFlash(ram, nvram)
+	if err != nil {
+		t.Fatal("Failed to convert image:", err)
+	}
+	if _, nvram2, _, _ := Extract(out); !bytes.Equal(nvram, nvram2) {
+		t.Error("NVRAM not added to flash image")
+	}
+
+	if _, err := ConvertToRAM(out, false); err != ErrorNVRAMNotEmpty {
+		t.Error("NVRAM dropped without asking:", err)
+	}
+	if out, err := ConvertToRAM(out, true); err != nil || !bytes.Equal(out, ram) {
+		t.Error("Wrong RAM image generated:", err)
+	}
+}
+
+func TestCodeFromHex(t *testing.T) {
+	ihex := []byte(":044000000240060272\n:03400600020000B5\n:00000001FF\n")
+
+	code, err := CodeFromHex(ihex)
+	if err != nil {
+		t.Fatal("Failed to parse hex file:", err)
+	}
+	if !bytes.Equal(code, []byte{0x02, 0x40, 0x06, 0x02, 0xff, 0xff, 0x02, 0x00, 0x00}) {
+		t.Errorf("Wrong code: %x", code)
+	}
+
+	bin, err := CodeFromBinary([]byte{0x02, 0x40, 0x06, 0x02, 0xff, 0xff, 0x02, 0x00, 0x00}, CodeAddress)
+	if err != nil || !bytes.Equal(code, bin) {
+		t.Error("Binary and hex file are not the same:", err)
+	}
+
+	/* Code in the bootrom area */
+	if _, err := CodeFromHex([]byte(":0100000000FF\n:00000001FF\n")); !errors.Is(err, ErrorCodeAddress) {
+		t.Error("Code below the firmware area accepted:", err)
+	}
+
+	/* Last byte overlaps with the checksums */
+	if _, err := CodeFromBinary(make([]byte, 8), 0xfff1); err != ErrorCodeTooLarge {
+		t.Error("Code overlapping with checksums accepted:", err)
+	}
+	if _, err := CodeFromBinary(make([]byte, 8), 0xfff0); err != nil {
+		t.Error("Code at end of image rejected:", err)
+	}
+
+	if _, err := CodeFromHex([]byte(":044000000240060272\n:02400200AABB57\n:00000001FF\n")); !errors.Is(err, ErrorCodeOverlap) {
+		t.Error("Overlapping records accepted:", err)
+	}
+
+	if _, err := CodeFromHex([]byte(":044000000240060273\n:00000001FF\n")); err == nil {
+		t.Error("Wrong checksum accepted")
+	}
+	if _, err := CodeFromHex([]byte(":044000000240060272\n")); err == nil {
+		t.Error("Missing end record accepted")
+	}
+}
+
+func testSplitJoin(t *testing.T, fw []byte) {
+	code, nvram, m, err := Split(fw)
+	if err != nil {
+		t.Fatal("Failed to split image:", err)
+	}
+	if h := sha1.Sum(code); m.CodeSHA1 != hex.EncodeToString(h[:]) {
+		t.Error("Wrong SHA-1 in metadata:", m.CodeSHA1)
+	}
+
+	/* The metadata is stored as JSON */
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal("Failed to encode metadata:", err)
+	}
+	var m2 Metadata
+	if err := json.Unmarshal(data, &m2); err != nil {
+		t.Fatal("Failed to decode metadata:", err)
+	}
+
+	fw2, err := Join(code, nvram, &m2)
+	if err != nil {
+		t.Fatal("Failed to join image:", err)
+	}
+	if !bytes.Equal(fw, fw2) {
+		t.Error("Joined image is not the same")
+	}
+
+	code[0x100]++
+	if _, err := Join(code, nvram, &m2); !errors.Is(err, ErrorMetadataMismatch) {
+		t.Error("Modified code accepted:", err)
+	}
+}
+
+func TestSplitJoin(t *testing.T) {
+	for _, isRam := range []bool{false, true} {
+		testSplitJoin(t, Build(getRandomBuf(0xc000-8), getRandomBuf(0x100), isRam))
+	}
+
+	/* Image with a modified header */
+	fw := Build(getRandomBuf(0xc000-8), nil, false)
+	copy(fw[0x19:], []byte{0xfe, 0x31, 0x00, 0x55})
+	copy(fw[0x100:], []byte("Hello"))
+	ChecksumUpdate(fw, false)
+	testSplitJoin(t, fw)
+
+	for _, path := range []string{"test/image_flash.bin", "test/image_ram.bin"} {
+		if fw, err := ioutil.ReadFile(path); err == nil {
+			testSplitJoin(t, fw)
+		}
+	}
+}
+
+func TestNVRAM(t *testing.T) {
+	data := bytes.Repeat([]byte{0xff}, NVRAMSize)
+	if !NVRAMErased(data) || NVRAMDump(data) != "*\n" {
+		t.Errorf("Wrong erased NVRAM: %q", NVRAMDump(data))
+	}
+
+	copy(data[0x10:], "JMicron\x00")
+	data[0x1ff] = 0x12
+	if NVRAMErased(data) {
+		t.Error("NVRAM in use reported as erased")
+	}
+
+	dump := NVRAMDump(data)
+	expected := "*\n010: 4a 4d 69 63 72 6f 6e 00 ff ff ff ff ff ff ff ff  JMicron.........\n*\n" +
+		"1f0: ff ff ff ff ff ff ff ff ff ff ff ff ff ff ff 12  ................\n"
+	if dump != expected {
+		t.Errorf("Wrong dump:\n%s", dump)
+	}
+}
+
+func TestNVRAMDiff(t *testing.T) {
+	a := bytes.Repeat([]byte{0xff}, NVRAMSize)
+	b := append([]byte{}, a...)
+	copy(b[0x50:], "1234")
+	b[0x100] = 0
+	copy(b[0x180:], make([]byte, 32))
+
+	diff, err := NVRAMDiff(a, b)
+	if err != nil {
+		t.Fatal("Failed to compare NVRAM:", err)
+	}
+
+	if len(diff) != 3 || diff[0] != "050-053: ff ff ff ff -> 31 32 33 34" || diff[1] != "100-100: ff -> 00" || diff[2] != "180-19f: 32 bytes" {
+		t.Error("Wrong difference:", diff)
+	}
+
+	if _, err := NVRAMDiff(a, b[:0x100]); err != ErrorInvalidLength {
+		t.Error("Short NVRAM accepted:", err)
+	}
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	headerMagic = 0x152d0579
+
+	typeMagicFlash = 0x03030505
+	typeMagicRAM   = 0x04040606
+)
+
+/* Info describes the contents of an image, it is also filled in for damaged images */
+type Info struct {
+	IsRam bool
+
+	Magic     uint32
+	TypeMagic uint32
+
+	/* The header matches the one that Build creates */
+	HeaderValid bool
+
+	/* Version stored at 0x18, the known images use 1 and "0103" */
+	VersionID uint8
+	Version   string
+
+	CRCs []CRCField
+
+	Code  []byte
+	NVRAM []byte
+}
+
+/* CRCValid returns true if every checksum is correct */
+func (i *Info) CRCValid() bool {
+	for _, m := range i.CRCs {
+		if !m.Valid() {
+			return false
+		}
+	}
+	return true
+}
+
+/* Inspect parses an image without rejecting it when the header or a checksum is wrong */
+func Inspect(image []byte) (*Info, error) {
+	if len(image) < 0xC400 {
+		return nil, ErrorInvalidLength
+	}
+
+	info := &Info{
+		Magic:     binary.BigEndian.Uint32(image[2:]),
+		TypeMagic: binary.BigEndian.Uint32(image[6:]),
+		VersionID: image[0x18],
+		Code:      image[0x400 : 0xC400-8],
+		NVRAM:     image[0xC400:],
+	}
+	info.IsRam = info.TypeMagic == typeMagicRAM
+
+	var hdr [0x18]byte
+	makeHeader(hdr[:], info.IsRam)
+	info.HeaderValid = bytes.Equal(hdr[:], image[:len(hdr)])
+
+	version := image[0x19:0x20]
+	if end := bytes.IndexByte(version, 0); end >= 0 {
+		version = version[:end]
+	}
+	info.Version = string(version)
+
+	info.CRCs = checksumFields(image, info.IsRam, false)
+
+	return info, nil
+}
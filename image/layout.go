@@ -0,0 +1,116 @@
+package image
+
+import "errors"
+
+type FlashRegion struct {
+	Name string
+
+	ImageOffset int
+	FlashAddr   uint32
+	Length      int
+
+	/* The region may be missing at the end of an image */
+	Optional bool
+}
+
+/* Data returns the part of the image that belongs to this region, it may be shorter than Length */
+func (r FlashRegion) Data(fw []byte) []byte {
+	if r.ImageOffset >= len(fw) {
+		return nil
+	}
+
+	end := r.ImageOffset + r.Length
+	if end > len(fw) {
+		end = len(fw)
+	}
+
+	return fw[r.ImageOffset:end]
+}
+
+/* A FlashLayout describes where the bootrom expects the parts of the firmware image to be in flash */
+type FlashLayout struct {
+	Regions []FlashRegion
+}
+
+var DefaultFlashLayout = FlashLayout{
+	Regions: []FlashRegion{
+		{Name: "header", ImageOffset: 0x0000, FlashAddr: 0x0e00, Length: 0x200},
+		{Name: "magic", ImageOffset: 0x0200, FlashAddr: 0x0000, Length: 0x200},
+		{Name: "code", ImageOffset: 0x0400, FlashAddr: 0x1000, Length: 0xc000},
+		{Name: "nvram", ImageOffset: 0xc400, FlashAddr: 0xd000, Length: 0x200, Optional: true},
+	},
+}
+
+var ErrorImageLayout = errors.New("image does not match flash layout")
+
+/* ImageSize returns the length of an image containing all regions */
+func (l *FlashLayout) ImageSize() int {
+	size := 0
+	for _, m := range l.Regions {
+		if end := m.ImageOffset + m.Length; end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+/* MinImageSize returns the length of an image containing all mandatory regions */
+func (l *FlashLayout) MinImageSize() int {
+	size := 0
+	for _, m := range l.Regions {
+		if end := m.ImageOffset + m.Length; !m.Optional && end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+/* FlashSize returns the amount of flash needed to store all regions */
+func (l *FlashLayout) FlashSize() int {
+	size := 0
+	for _, m := range l.Regions {
+		if end := int(m.FlashAddr) + m.Length; end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+func (l *FlashLayout) Region(name string) (FlashRegion, bool) {
+	for _, m := range l.Regions {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return FlashRegion{}, false
+}
+
+/* Write stores every region of the image in flash using the given function */
+func (l *FlashLayout) Write(fw []byte, write func(offset uint32, data []byte) (int, error)) error {
+	if len(fw) < l.MinImageSize() || len(fw) > l.ImageSize() {
+		return ErrorImageLayout
+	}
+
+	for _, m := range l.Regions {
+		if data := m.Data(fw); len(data) > 0 {
+			if _, err := write(m.FlashAddr, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Read gets every region from flash using the given function and returns the complete image */
+func (l *FlashLayout) Read(read func(offset uint32, data []byte) (int, error)) ([]byte, error) {
+	fw := make([]byte, l.ImageSize())
+
+	for _, m := range l.Regions {
+		if _, err := read(m.FlashAddr, m.Data(fw)); err != nil {
+			return nil, err
+		}
+	}
+
+	return fw, nil
+}
@@ -0,0 +1,88 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* The NVRAM block (flash 0xd000) holds the settings of the firmware, like the USB IDs and strings.
+ * Its layout has not been derived from the code that reads it yet, so the block is only shown as
+ * bytes and never changed by this package. */
+
+/* NVRAMErased checks if the block is erased, the firmware then uses its defaults */
+func NVRAMErased(data []byte) bool {
+	for _, m := range data {
+		if m != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+/* NVRAMDump returns a hex dump of the block. Lines that are erased are left out. */
+func NVRAMDump(data []byte) string {
+	var result strings.Builder
+
+	skipped := false
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+
+		line := data[i:end]
+		if NVRAMErased(line) {
+			skipped = true
+			continue
+		}
+		if skipped {
+			result.WriteString("*\n")
+			skipped = false
+		}
+
+		fmt.Fprintf(&result, "%03x: % x", i, line)
+		result.WriteString(strings.Repeat("   ", 16-len(line)))
+		result.WriteString("  ")
+		for _, m := range line {
+			if m < 0x20 || m > 0x7e {
+				m = '.'
+			}
+			result.WriteByte(m)
+		}
+		result.WriteString("\n")
+	}
+
+	if skipped {
+		result.WriteString("*\n")
+	}
+
+	return result.String()
+}
+
+/* NVRAMDiff lists the byte ranges that differ between two blocks */
+func NVRAMDiff(from []byte, to []byte) ([]string, error) {
+	if len(from) != NVRAMSize || len(to) != NVRAMSize {
+		return nil, ErrorInvalidLength
+	}
+
+	var result []string
+	for i := 0; i < len(from); i++ {
+		if from[i] == to[i] {
+			continue
+		}
+
+		start := i
+		for i < len(from) && from[i] != to[i] {
+			i++
+		}
+
+		/* Long ranges would not be readable, the dump shows them */
+		if i-start > 16 {
+			result = append(result, fmt.Sprintf("%03x-%03x: %d bytes", start, i-1, i-start))
+		} else {
+			result = append(result, fmt.Sprintf("%03x-%03x: % x -> % x", start, i-1, from[start:i], to[start:i]))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrorChipTooSmall = errors.New("flash chip is too small for image")
+
+/* RawBuild turns a flash firmware image into the full contents of a flash chip of the
+ * given size, suitable for writing with an external programmer. Unused space is left erased. */
+func (l *FlashLayout) RawBuild(fw []byte, chipSize int) ([]byte, error) {
+	if err := Validate(fw, false); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, chipSize)
+	for i := range raw {
+		raw[i] = 0xff
+	}
+
+	err := l.Write(fw, func(offset uint32, data []byte) (int, error) {
+		if int(offset)+len(data) > len(raw) {
+			return 0, ErrorChipTooSmall
+		}
+		return copy(raw[offset:], data), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+/* RawExtract takes a dump of the complete flash chip and returns the firmware image stored in it */
+func (l *FlashLayout) RawExtract(raw []byte) ([]byte, error) {
+	if len(raw) < l.FlashSize() {
+		return nil, ErrorInvalidLength
+	}
+
+	fw, err := l.Read(func(offset uint32, data []byte) (int, error) {
+		return copy(data, raw[offset:]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Validate(fw, false); err != nil {
+		return nil, fmt.Errorf("flash does not contain a valid firmware: %w", err)
+	}
+
+	return fw, nil
+}
@@ -0,0 +1,163 @@
+package image
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+/* A HeaderPatch stores bytes of the first 0x400 bytes of an image that Build does not create */
+type HeaderPatch struct {
+	Offset int    `json:"offset"`
+	Data   string `json:"data"`
+}
+
+/* MetadataCRC is a checksum of the original image, it is used to check the reassembled image */
+type MetadataCRC struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+/* Metadata describes everything in an image except the code and NVRAM */
+type Metadata struct {
+	Type      string `json:"type"`
+	VersionID uint8  `json:"versionId"`
+	Version   string `json:"version"`
+
+	/* The firmware database identifies the code by its SHA-1 */
+	CodeSHA256  string `json:"codeSha256"`
+	CodeSHA1    string `json:"codeSha1,omitempty"`
+	NVRAMSHA256 string `json:"nvramSha256,omitempty"`
+	NVRAMLength int    `json:"nvramLength"`
+
+	Header []HeaderPatch `json:"header,omitempty"`
+	CRCs   []MetadataCRC `json:"crcs"`
+}
+
+var ErrorMetadataMismatch = errors.New("parts do not match the metadata")
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func imageType(isRam bool) string {
+	if isRam {
+		return "ram"
+	}
+	return "flash"
+}
+
+/* joinBase creates the image that Build makes for the metadata, before the header patches are applied */
+func joinBase(code []byte, nvram []byte, m *Metadata) []byte {
+	fw := Build(code, nil, m.Type == "ram")[:0xC400]
+
+	fw[0x18] = m.VersionID
+	for i := 0x19; i < 0x20; i++ {
+		fw[i] = 0
+	}
+	copy(fw[0x19:0x20], []byte(m.Version))
+
+	return append(fw, nvram...)
+}
+
+/* Split divides a valid image in code, NVRAM and a description of the other bytes. Join
+ * recreates the same image from these parts. */
+func Split(fw []byte) ([]byte, []byte, *Metadata, error) {
+	code, nvram, isRam, err := Extract(fw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	info, err := Inspect(fw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	m := &Metadata{
+		Type:        imageType(isRam),
+		VersionID:   info.VersionID,
+		Version:     info.Version,
+		CodeSHA256:  sha256Hex(code),
+		CodeSHA1:    sha1Hex(code),
+		NVRAMLength: len(nvram),
+	}
+	if !utf8.ValidString(m.Version) {
+		/* JSON cannot store it, so it is recorded as header patch */
+		m.Version = ""
+	}
+	if len(nvram) > 0 {
+		m.NVRAMSHA256 = sha256Hex(nvram)
+	}
+
+	for _, c := range info.CRCs {
+		m.CRCs = append(m.CRCs, MetadataCRC{Name: c.Name, Value: fmt.Sprintf("%08x", c.Stored)})
+	}
+
+	/* Record the bytes that differ, the checksums are recalculated by Join */
+	base := joinBase(code, nvram, m)
+	for _, c := range info.CRCs {
+		copy(base[c.Offset:c.Offset+4], fw[c.Offset:])
+	}
+
+	for i := 0; i < 0x400; {
+		if base[i] == fw[i] {
+			i++
+			continue
+		}
+
+		start := i
+		for i < 0x400 && base[i] != fw[i] {
+			i++
+		}
+		m.Header = append(m.Header, HeaderPatch{Offset: start, Data: hex.EncodeToString(fw[start:i])})
+	}
+
+	return code, nvram, m, nil
+}
+
+/* Join is the inverse of Split, it checks that the result matches the hashes and checksums in the metadata */
+func Join(code []byte, nvram []byte, m *Metadata) ([]byte, error) {
+	if m.Type != "ram" && m.Type != "flash" {
+		return nil, fmt.Errorf("unknown image type %q", m.Type)
+	}
+	if len(code) != CodeSize {
+		return nil, ErrorCodeTooLarge
+	}
+	if sha256Hex(code) != m.CodeSHA256 || (m.CodeSHA1 != "" && sha1Hex(code) != m.CodeSHA1) {
+		return nil, fmt.Errorf("code: %w", ErrorMetadataMismatch)
+	}
+	if len(nvram) != m.NVRAMLength || (len(nvram) > 0 && sha256Hex(nvram) != m.NVRAMSHA256) {
+		return nil, fmt.Errorf("nvram: %w", ErrorMetadataMismatch)
+	}
+
+	fw := joinBase(code, nvram, m)
+	for _, p := range m.Header {
+		data, err := hex.DecodeString(p.Data)
+		if err != nil || p.Offset < 0 || p.Offset+len(data) > 0x400 {
+			return nil, fmt.Errorf("invalid header patch at %04x", p.Offset)
+		}
+		copy(fw[p.Offset:], data)
+	}
+
+	isRam := m.Type == "ram"
+	fields := checksumFields(fw, isRam, true)
+	if len(fields) != len(m.CRCs) {
+		return nil, fmt.Errorf("checksums: %w", ErrorMetadataMismatch)
+	}
+	for i, c := range fields {
+		if m.CRCs[i].Name != c.Name || m.CRCs[i].Value != fmt.Sprintf("%08x", c.Calculated) {
+			return nil, fmt.Errorf("checksum %s: %w", c.Name, ErrorMetadataMismatch)
+		}
+	}
+
+	return fw, Validate(fw, isRam)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/BertoldVdb/jms578flash/jmshal"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+)
+
+func runInfo(jms *jmshal.JMSHal) {
+	if version, err := jms.VersionGet(); err != nil {
+		log.Println("Failed to read firmware version:", err)
+	} else if version == 0 {
+		fmt.Println("Firmware:     none (running bootrom)")
+	} else {
+		fmt.Printf("Firmware:     %08x\n", version)
+	}
+
+	hookVersion, _ := jms.PatchVersion()
+	if hookVersion == "" {
+		hookVersion = "not installed"
+	}
+	fmt.Println("Hooks:       ", hookVersion)
+
+	flash, err := jms.FlashOpen()
+	if err != nil {
+		log.Fatalln("Failed to identify flash:", err)
+	}
+
+	id := flash.DeviceID()
+	device := flash.Device()
+	fmt.Printf("Flash:        %s (JEDEC ID %x, %dkB)\n", device.Name, id[:], device.ChipSize/1024)
+
+	if uid, err := flash.UniqueID(); err == nil {
+		fmt.Printf("Unique ID:    %x\n", uid)
+	} else if errors.Is(err, spiflash.ErrorUniqueIDTooLong) {
+		log.Println("Failed to read unique ID:", err, "(the DMA hooks are needed, use -hook)")
+	} else if err != spiflash.ErrorNotSupported {
+		log.Println("Failed to read unique ID:", err)
+	}
+
+	status, err := flash.StatusRead()
+	if err != nil {
+		log.Fatalln("Failed to read flash status:", err)
+	}
+	fmt.Println("Status:      ", status)
+
+	if start, length := flash.ProtectedRange(status); length == 0 {
+		fmt.Println("Protected:    none")
+	} else {
+		fmt.Printf("Protected:    %06x-%06x\n", start, start+length-1)
+	}
+}
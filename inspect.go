@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/jmsmods"
+)
+
+func loadFirmwareDatabase(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	err := jmsmods.LoadFirmwareDatabase(path)
+
+	/* It is fine if the default database does not exist */
+	if errors.Is(err, fs.ErrNotExist) && path == jmsmods.DefaultFirmwareDatabasePath() {
+		return nil
+	}
+	return err
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func printNVRAMSummary(nvram []byte) {
+	used := 0
+	for _, m := range nvram {
+		if m != 0xff {
+			used++
+		}
+	}
+
+	if len(nvram) == 0 {
+		fmt.Println("NVRAM:        not present")
+	} else if used == 0 {
+		fmt.Printf("NVRAM:        %d bytes, empty\n", len(nvram))
+	} else {
+		fmt.Printf("NVRAM:        %d bytes, %d bytes not erased\n", len(nvram), used)
+	}
+}
+
+func runInspect(firmware string) {
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	info, err := image.Inspect(fw)
+	if err != nil {
+		log.Fatalln("Failed to parse firmware:", err)
+	}
+
+	imageType := "flash"
+	if info.IsRam {
+		imageType = "RAM"
+	}
+	fmt.Printf("File:         %s (%d bytes, %s image)\n", firmware, len(fw), imageType)
+
+	headerState := "valid"
+	if !info.HeaderValid {
+		headerState = "INVALID"
+	}
+	fmt.Printf("Header:       %s (magic %08x, type %08x)\n", headerState, info.Magic, info.TypeMagic)
+	fmt.Printf("Version:      %d/%s\n", info.VersionID, info.Version)
+
+	state := jmsmods.PatchInspect(info.Code)
+	if known, ok := jmsmods.FirmwareLookup(info.Code); ok {
+		fmt.Printf("Firmware:     %s, version %s (code SHA-1 %x)\n", known.Name, known.Version, known.SHA1)
+		if known.URL != "" {
+			fmt.Println("Download:    ", known.URL)
+		}
+
+		var mods []string
+		for m := range known.Mods {
+			mods = append(mods, string(m))
+		}
+		sort.Strings(mods)
+		if len(mods) > 0 {
+			fmt.Println("Mods:        ", strings.Join(mods, ", "))
+		}
+	} else {
+		fmt.Printf("Firmware:     unknown (code SHA-1 %x)\n", sha1.Sum(info.Code))
+	}
+
+	if state.Hooks {
+		fmt.Printf("Hooks:        version %s, %d usable\n", state.HookVersion, state.HookCount)
+	} else {
+		fmt.Println("Hooks:        not installed")
+	}
+	fmt.Println("NoDebug:     ", yesNo(state.NoDebug))
+
+	printNVRAMSummary(info.NVRAM)
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CRC\tOffset\tStored\tCalculated\tState")
+	for _, m := range info.CRCs {
+		crcState := "ok"
+		if !m.Valid() {
+			crcState = "BAD"
+		}
+		fmt.Fprintf(w, "%s\t%04x\t%08x\t%08x\t%s\n", m.Name, m.Offset, m.Stored, m.Calculated, crcState)
+	}
+	w.Flush()
+}
+
+func runFixCRC(firmware string, output string) {
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	fields, err := image.ChecksumRepair(fw)
+	if err != nil {
+		log.Fatalln("Failed to update checksums:", err)
+	}
+
+	changed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CRC\tOffset\tBefore\tAfter\tState")
+	for _, m := range fields {
+		crcState := "ok"
+		if !m.Valid() {
+			crcState = "fixed"
+			changed++
+		}
+		fmt.Fprintf(w, "%s\t%04x\t%08x\t%08x\t%s\n", m.Name, m.Offset, m.Stored, m.Calculated, crcState)
+	}
+	w.Flush()
+
+	if changed == 0 {
+		log.Println("All checksums are correct, nothing written")
+		return
+	}
+
+	if err := os.WriteFile(output, fw, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Println(changed, "checksums updated, written to", output)
+}
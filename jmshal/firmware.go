@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/jmsmods"
 )
 
 func (d *JMSHal) VersionGet() (uint32, error) {
@@ -70,6 +71,23 @@ func (d *JMSHal) CodeWrite(buf []byte, useVendorPath bool, useRawLoad bool) erro
 	return errors.New("failed to start code, no working method")
 }
 
+/* RunFirmware starts a flash or RAM image from RAM without writing it to the flash. After a
+ * reset the firmware in flash is started again. */
+func (d *JMSHal) RunFirmware(fw []byte, mods []jmsmods.Mod) error {
+	code, _, isRam, err := image.Extract(fw)
+	if err != nil {
+		return err
+	}
+
+	code, err = jmsmods.PatchCode(code, mods)
+	if err != nil {
+		return err
+	}
+
+	d.log("Starting firmware from RAM (RAM image: %v)", isRam)
+	return d.CodeWrite(code, true, false)
+}
+
 func (d *JMSHal) codeRead(offset uint16, buf []byte) (int, error) {
 	if len(buf) > 255 {
 		buf = buf[:255]
@@ -3,6 +3,7 @@ package jmshal
 import (
 	"bytes"
 	"errors"
+	"fmt"
 
 	"github.com/BertoldVdb/jms578flash/image"
 	"github.com/BertoldVdb/jms578flash/jmsmods"
@@ -11,71 +12,127 @@ import (
 	_ "embed"
 )
 
-func (d *JMSHal) FlashWriteFirmware(fw []byte, verify bool) error {
-	if !d.unsafe {
-		return errors.New("flash write requires unsafeAllow=true")
+/* FlashOpen identifies the flash chip and returns an object to access it */
+func (d *JMSHal) FlashOpen() (*spiflash.Flash, error) {
+	flash, err := spiflash.New(d.SPI, d.SPIMaxTransactionSize())
+	if err != nil {
+		return nil, err
 	}
 
-	if len(fw) < 0xc400 {
-		return errors.New("firmware file too small")
+	for _, m := range flash.Warnings() {
+		d.log("Flash warning: %s", m)
 	}
 
-	flash, err := spiflash.New(d.SPI, d.SPIMaxTransactionSize())
+	/* The program hook only handles 256 byte pages */
+	if d.spiProgramInstalled() && flash.Device().PageSize == 256 {
+		flash.SetPageProgram(d.spiProgram, 256)
+	}
+
+	return flash, nil
+}
+
+func (d *JMSHal) flashUnprotect(flash *spiflash.Flash) error {
+	status, err := flash.StatusRead()
 	if err != nil {
 		return err
 	}
 
-	if err := flash.EraseChip(); err != nil {
-		return err
+	if status.BlockProtect() == 0 && !status.WriteDisabled() {
+		return nil
 	}
 
-	if _, err := flash.Write(0x0e00, fw[:0x200]); err != nil {
-		return err
+	d.log("Flash is write protected (%s), removing protection", status)
+	return flash.Unprotect()
+}
+
+/* FlashProtect sets or clears the block protect bits. When srwd is set, the protection cannot
+ * be removed anymore while the WP pin of the flash is pulled low. */
+func (d *JMSHal) FlashProtect(enable bool, srwd bool) error {
+	if !d.unsafe {
+		return errors.New("changing flash protection requires unsafeAllow=true")
 	}
-	if _, err := flash.Write(0x0000, fw[0x200:0x400]); err != nil {
+
+	flash, err := d.FlashOpen()
+	if err != nil {
 		return err
 	}
-	if _, err := flash.Write(0x1000, fw[0x400:0xc400]); err != nil {
+
+	if enable {
+		return flash.Protect(srwd)
+	}
+	return flash.Unprotect()
+}
+
+func (d *JMSHal) FlashWriteFirmware(fw []byte, verify bool) error {
+	if !d.unsafe {
+		return errors.New("flash write requires unsafeAllow=true")
+	}
+
+	if len(fw) < d.Layout.MinImageSize() {
+		return errors.New("firmware file too small")
+	}
+	if len(fw) > d.Layout.ImageSize() {
+		return errors.New("firmware file too large")
+	}
+
+	flash, err := d.FlashOpen()
+	if err != nil {
 		return err
 	}
-	if _, err = flash.Write(0xd000, fw[0xc400:]); err != nil {
+
+	if err := d.flashUnprotect(flash); err != nil {
 		return err
 	}
 
+	fw = d.flashPadImage(fw)
+
+	/* When the flash can be checked on the device, only the sectors that changed are written */
+	if d.spiCRCInstalled() {
+		if err := d.flashWriteChanged(flash, fw); err != nil {
+			return err
+		}
+	} else {
+		if err := flash.EraseChip(); err != nil {
+			return err
+		}
+
+		if err := d.Layout.Write(fw, flash.Write); err != nil {
+			return err
+		}
+	}
+
 	if verify {
-		rb, err := d.FlashReadFirmware()
+		diff, err := d.flashDiff(flash, fw)
 		if err != nil {
 			return err
 		}
 
-		if !bytes.Equal(rb, fw) {
-			return errors.New("verify failed")
+		if len(diff) > 0 {
+			return fmt.Errorf("verify failed at %06x", diff[0].addr)
 		}
 	}
 
 	return nil
 }
 
-func (d *JMSHal) FlashReadFirmware() ([]byte, error) {
-	flash, err := spiflash.New(d.SPI, d.SPIMaxTransactionSize())
-	if err != nil {
-		return nil, err
+/* flashPadImage adds the optional regions that are missing from the image as erased data. The
+ * chip erase clears them, writing only the changed sectors must give the same result. */
+func (d *JMSHal) flashPadImage(fw []byte) []byte {
+	size := d.Layout.ImageSize()
+	if len(fw) >= size {
+		return fw
 	}
 
-	fw := make([]byte, 0xc400+0x200)
+	return append(append([]byte(nil), fw...), bytes.Repeat([]byte{0xff}, size-len(fw))...)
+}
 
-	if _, err := flash.Read(0x0e00, fw[:0x200]); err != nil {
-		return nil, err
-	}
-	if _, err := flash.Read(0x0000, fw[0x200:0x400]); err != nil {
-		return nil, err
-	}
-	if _, err := flash.Read(0x1000, fw[0x400:0xc400]); err != nil {
+func (d *JMSHal) FlashReadFirmware() ([]byte, error) {
+	flash, err := d.FlashOpen()
+	if err != nil {
 		return nil, err
 	}
 
-	_, err = flash.Read(0xd000, fw[0xc400:])
-	return fw, err
+	return d.Layout.Read(flash.Read)
 }
 
 func (d *JMSHal) FlashEraseFirmware() error {
@@ -83,11 +140,15 @@ func (d *JMSHal) FlashEraseFirmware() error {
 		return errors.New("flash erase requires unsafeAllow=true")
 	}
 
-	flash, err := spiflash.New(d.SPI, d.SPIMaxTransactionSize())
+	flash, err := d.FlashOpen()
 	if err != nil {
 		return err
 	}
 
+	if err := d.flashUnprotect(flash); err != nil {
+		return err
+	}
+
 	return flash.ErasePage(0)
 }
 
@@ -157,32 +218,110 @@ func (d *JMSHal) RebootToPatched(bootrom []byte) error {
 	return errors.New("patched bootrom did not start running")
 }
 
+type FlashOptions struct {
+	/* Add hooks to the firmware so this library can access it without rebooting */
+	AddHooks bool
+
+	Mods []jmsmods.Mod
+
+	/* Start the firmware after writing it */
+	Boot bool
+
+	/* Write protect the flash after writing, optionally also setting the status register write disable bit */
+	Protect     bool
+	ProtectSRWD bool
+
+	/* Write the firmware even if it is known not to support the flash chip */
+	IgnoreCompatibility bool
+
+	/* Replace the NVRAM of the firmware with the one currently in flash */
+	KeepNVRAM bool
+}
+
+/* flashIdentify opens the flash without changing anything. The bootrom gives no access to the
+ * flash, in that case the patched bootrom is loaded first, which does not erase anything. */
+func (d *JMSHal) flashIdentify(bootrom []byte) (*spiflash.Flash, error) {
+	flash, err := d.FlashOpen()
+	if err == nil || bootrom == nil {
+		return flash, err
+	}
+
+	if version, verr := d.VersionGet(); verr != nil || version != 0 || d.hookVersion != "" {
+		return nil, err
+	}
+
+	if err := d.RebootToPatched(bootrom); err != nil {
+		return nil, err
+	}
+	return d.FlashOpen()
+}
+
 /* This is the main function that does the whole flash procedure */
-func (d *JMSHal) FlashPatchWriteAndBootFW(bootrom []byte, fw []byte, addHooks bool, mods []jmsmods.Mod, bootIt bool) error {
-	if addHooks {
+func (d *JMSHal) FlashPatchWriteAndBootFW(bootrom []byte, fw []byte, opts FlashOptions) error {
+	/* Check everything before the reboot, which erases the firmware in flash */
+	flash, err := d.flashIdentify(bootrom)
+	if err != nil {
+		return err
+	}
+	device := flash.Device()
+	id := flash.DeviceID()
+
+	mods := opts.Mods
+	if opts.AddHooks {
 		mods = append(mods, jmsmods.ModAddHooks)
 	}
-	fw, err := jmsmods.PatchCreate(fw, mods)
+
+	if err := d.flashCheckCompatible(fw, mods, device, opts.IgnoreCompatibility); err != nil {
+		return err
+	}
+
+	if opts.KeepNVRAM {
+		for _, m := range mods {
+			if m == jmsmods.ModClearNVRAM {
+				return fmt.Errorf("cannot keep the NVRAM when using %s", m)
+			}
+		}
+
+		fw, err = d.flashKeepNVRAM(flash, fw)
+		if err != nil {
+			return err
+		}
+	}
+
+	fw, err = jmsmods.PatchCreate(fw, mods)
 	if err != nil {
 		return err
 	}
 
+	if len(fw) > d.Layout.ImageSize() {
+		return errors.New("file is too large")
+	}
+	fw = d.flashPadImage(fw)
+
 	if bootrom != nil {
 		if err := d.RebootToPatched(bootrom); err != nil {
 			return err
 		}
+
+		/* The patched bootrom may access the flash in another way */
+		if flash, err = d.FlashOpen(); err != nil {
+			return err
+		}
+		if flash.DeviceID() != id {
+			return errors.New("flash chip changed after reboot")
+		}
 	}
 
-	currentFw, err := d.FlashReadFirmware()
+	diff, err := d.flashDiff(flash, fw)
 	if err != nil {
 		return err
 	}
 
-	if len(fw) > len(currentFw) {
-		return errors.New("file is too large")
-	}
+	if len(diff) == 0 {
+		if err := d.flashProtectAfterWrite(opts); err != nil {
+			return err
+		}
 
-	if bytes.Equal(fw, currentFw[:len(fw)]) {
 		if version, err := d.VersionGet(); err != nil {
 			return err
 		} else if version == 0 {
@@ -195,9 +334,36 @@ func (d *JMSHal) FlashPatchWriteAndBootFW(bootrom []byte, fw []byte, addHooks bo
 		return err
 	}
 
-	if !bootIt {
+	if err := d.flashProtectAfterWrite(opts); err != nil {
+		return err
+	}
+
+	if !opts.Boot {
 		return nil
 	}
 
 	return d.ResetChip()
 }
+
+func (d *JMSHal) flashCheckCompatible(fw []byte, mods []jmsmods.Mod, device spiflash.DeviceInfo, ignore bool) error {
+	err := jmsmods.FlashCompatible(fw, device.ID, mods)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, jmsmods.ErrorFlashUnsupported) && !ignore {
+		return fmt.Errorf("%s: %w", device.Name, err)
+	}
+
+	d.log("Flash compatibility warning for %s: %v", device.Name, err)
+	return nil
+}
+
+func (d *JMSHal) flashProtectAfterWrite(opts FlashOptions) error {
+	if !opts.Protect {
+		return nil
+	}
+
+	d.log("Enabling flash write protection")
+	return d.FlashProtect(true, opts.ProtectSRWD)
+}
@@ -1,6 +1,7 @@
 package jmshal
 
 import (
+	"github.com/BertoldVdb/jms578flash/image"
 	"github.com/BertoldVdb/jms578flash/jmsmods"
 	"github.com/BertoldVdb/jms578flash/scsi"
 )
@@ -13,6 +14,14 @@ type JMSHal struct {
 
 	unsafe bool
 
+	/* Longest 0xdf command the firmware accepts, only probed when xdataLong is set */
+	xdataReadMax  int
+	xdataWriteMax int
+	xdataLong     bool
+
+	/* Where the firmware image is stored in flash */
+	Layout image.FlashLayout
+
 	LogFunc func(format string, params ...any)
 }
 
@@ -26,6 +35,10 @@ func New(dev *scsi.SCSI, unsafe bool) (*JMSHal, error) {
 	d := &JMSHal{
 		dev:    dev,
 		unsafe: unsafe,
+		Layout: image.DefaultFlashLayout,
+
+		xdataReadMax:  xdataMaxDefault,
+		xdataWriteMax: xdataMaxDefault,
 	}
 
 	if err := d.hookUpdateAvailable(); err != nil {
@@ -40,8 +53,16 @@ func (d *JMSHal) reopen() error {
 		return err
 	}
 
-	return d.hookUpdateAvailable()
+	/* Another firmware may be running now */
+	d.xdataReadMax = xdataMaxDefault
+	d.xdataWriteMax = xdataMaxDefault
+
+	if err := d.hookUpdateAvailable(); err != nil {
+		return err
+	}
+	d.xdataProbe()
 
+	return nil
 }
 
 func (d *JMSHal) ResetChip() error {
@@ -0,0 +1,105 @@
+package jmshal
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/jmsmods"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+)
+
+func (d *JMSHal) nvramRegion() (image.FlashRegion, error) {
+	region, ok := d.Layout.Region("nvram")
+	if !ok || region.Length < image.NVRAMSize {
+		return image.FlashRegion{}, errors.New("flash layout has no NVRAM")
+	}
+	return region, nil
+}
+
+/* NVRAMRead returns the NVRAM block stored in flash */
+func (d *JMSHal) NVRAMRead() ([]byte, error) {
+	region, err := d.nvramRegion()
+	if err != nil {
+		return nil, err
+	}
+
+	flash, err := d.FlashOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, image.NVRAMSize)
+	if _, err := flash.Read(region.FlashAddr, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+/* flashKeepNVRAM replaces the NVRAM of the image with the one in flash. It must be called before
+ * anything is erased, rebooting to the patched bootrom may erase the NVRAM together with the
+ * header. The layout of the NVRAM belongs to the firmware, so a warning is shown when the
+ * firmware changes. An erased NVRAM is kept as well, the vendor firmware is shipped that way. */
+func (d *JMSHal) flashKeepNVRAM(flash *spiflash.Flash, fw []byte) ([]byte, error) {
+	region, err := d.nvramRegion()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := d.Layout.Read(flash.Read)
+	if err != nil {
+		return nil, err
+	}
+	kept := region.Data(current)[:image.NVRAMSize]
+
+	/* The NVRAM is gone after the update, so make sure it was read correctly */
+	check := make([]byte, image.NVRAMSize)
+	if _, err := flash.Read(region.FlashAddr, check); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(kept, check) {
+		return nil, errors.New("NVRAM in flash reads differently every time, refusing to keep it")
+	}
+
+	oldInfo, err := image.Inspect(current)
+	if err != nil {
+		return nil, err
+	}
+	newInfo, err := image.Inspect(fw)
+	if err != nil {
+		return nil, err
+	}
+
+	oldName := jmsmods.PatchInspect(oldInfo.Code).Firmware
+	newName := jmsmods.PatchInspect(newInfo.Code).Firmware
+	if oldInfo.VersionID != newInfo.VersionID || oldInfo.Version != newInfo.Version {
+		d.log("Warning: firmware version changes from %d/%s to %d/%s, the NVRAM layout may be different",
+			oldInfo.VersionID, oldInfo.Version, newInfo.VersionID, newInfo.Version)
+	} else if oldName != "" && newName != "" && oldName != newName {
+		d.log("Warning: firmware changes from %s to %s, the NVRAM layout may be different", oldName, newName)
+	}
+
+	/* Add the NVRAM region if the image does not have it */
+	fw = append([]byte(nil), fw...)
+	if end := region.ImageOffset + image.NVRAMSize; len(fw) < end {
+		fw = append(fw, make([]byte, end-len(fw))...)
+	}
+	nvram := region.Data(fw)[:image.NVRAMSize]
+
+	diff, err := image.NVRAMDiff(nvram, kept)
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) == 0 {
+		d.log("NVRAM of the image is the same as in flash")
+	} else {
+		d.log("Keeping the NVRAM in flash, changes compared to the image:")
+		for _, m := range diff {
+			d.log("  %s", m)
+		}
+	}
+
+	copy(nvram, kept)
+	return fw, nil
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+
+	"github.com/BertoldVdb/jms578flash/spiflash"
 )
 
 var ErrorSPIViolated = errors.New("SPI interface cannot handle transaction")
@@ -98,6 +100,49 @@ func (d *JMSHal) spiDMARx(out []byte, in []byte) error {
 	return err
 }
 
+func (d *JMSHal) spiProgramInstalled() bool {
+	return len(d.hooks) >= 4
+}
+
+/* spiProgram writes a 256 byte page, the hook sends the write enable and program commands
+ * and polls the status register until the chip is done */
+func (d *JMSHal) spiProgram(offset uint32, data []byte, errorMask uint8) (int, error) {
+	if !d.spiProgramInstalled() || offset%256 != 0 || len(data) != 256 {
+		return 0, ErrorSPIViolated
+	}
+
+	/* The hook puts the command in the 4 bytes before the page, both must fit in the buffer */
+	workBuf := uint16(0x3700)
+
+	if _, err := d.XDATAWrite(workBuf+4, data); err != nil {
+		return 0, err
+	}
+
+	ctx := CPUContext{}
+	ctx.ACC = errorMask
+	ctx.R[1] = byte(offset >> 16)
+	ctx.R[2] = byte(offset >> 8)
+	ctx.R[3] = byte(offset)
+	binary.LittleEndian.PutUint16(ctx.R[4:], workBuf)
+
+	result, err := d.hookCallIndex(3, ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	/* R7 is cleared when the page was written */
+	d.log("SPI program: %06x -> status=%02x, result=%d", offset, result.ACC, result.R[7])
+
+	if result.R[7] != 0 {
+		if result.ACC&1 > 0 {
+			return 0, spiflash.ErrorTimeout
+		}
+		return 0, spiflash.ErrorProgramFailed
+	}
+
+	return len(data), nil
+}
+
 func (d *JMSHal) spi(out []byte, in []byte) error {
 	/* Check which SPI implementation can do this */
 	if err := d.spiDMATx(out, in); err == nil {
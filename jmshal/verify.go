@@ -0,0 +1,165 @@
+package jmshal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+)
+
+func (d *JMSHal) spiCRCInstalled() bool {
+	return len(d.hooks) >= 5
+}
+
+/* flashCRC calculates image.CRC over a flash range on the device, so the data does not need to be transferred */
+func (d *JMSHal) flashCRC(offset uint32, length int) (uint32, error) {
+	if !d.spiCRCInstalled() || offset%256 != 0 || length%256 != 0 {
+		return 0, ErrorSPIViolated
+	}
+
+	/* The hook reads the command from here and uses the 256 bytes before it as buffer */
+	cmdBuf := uint16(0x3800)
+
+	crc := uint32(0xffffffff)
+	for length > 0 {
+		/* Do not keep the CPU busy for too long in a single call */
+		chunks := length / 256
+		if chunks > 16 {
+			chunks = 16
+		}
+
+		cmd := []byte{0x03, byte(offset >> 16), byte(offset >> 8), byte(offset)}
+		if _, err := d.XDATAWrite(cmdBuf, cmd); err != nil {
+			return 0, err
+		}
+
+		ctx := CPUContext{}
+		binary.BigEndian.PutUint32(ctx.R[:], crc)
+		ctx.R[7] = byte(chunks)
+
+		result, err := d.hookCallIndex(4, ctx)
+		if err != nil {
+			return 0, err
+		}
+		crc = binary.BigEndian.Uint32(result.R[:])
+
+		offset += uint32(chunks * 256)
+		length -= chunks * 256
+	}
+
+	return crc, nil
+}
+
+type flashPart struct {
+	addr uint32
+	data []byte
+}
+
+/* A flashSector is the smallest erasable area of the flash, with the parts of the image stored in it */
+type flashSector struct {
+	addr  uint32
+	parts []flashPart
+}
+
+func (d *JMSHal) flashSectors(fw []byte, size uint32) []flashSector {
+	var sectors []flashSector
+	index := make(map[uint32]int)
+
+	for _, m := range d.Layout.Regions {
+		data := m.Data(fw)
+		addr := m.FlashAddr
+
+		for len(data) > 0 {
+			sector := addr - addr%size
+			n := int(sector + size - addr)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			i, ok := index[sector]
+			if !ok {
+				i = len(sectors)
+				index[sector] = i
+				sectors = append(sectors, flashSector{addr: sector})
+			}
+			sectors[i].parts = append(sectors[i].parts, flashPart{addr: addr, data: data[:n]})
+
+			addr += uint32(n)
+			data = data[n:]
+		}
+	}
+
+	sort.Slice(sectors, func(i, j int) bool {
+		return sectors[i].addr < sectors[j].addr
+	})
+
+	return sectors
+}
+
+/* flashSectorMatches compares a sector with the image, using the CRC hook when it is available */
+func (d *JMSHal) flashSectorMatches(flash *spiflash.Flash, s flashSector) (bool, error) {
+	for _, m := range s.parts {
+		crc, err := d.flashCRC(m.addr, len(m.data))
+		if err == nil {
+			if crc != image.CRC(m.data) {
+				return false, nil
+			}
+			continue
+		} else if err != ErrorSPIViolated {
+			return false, err
+		}
+
+		buf := make([]byte, len(m.data))
+		if _, err := flash.Read(m.addr, buf); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(buf, m.data) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+/* flashDiff returns the sectors where the flash does not contain the image */
+func (d *JMSHal) flashDiff(flash *spiflash.Flash, fw []byte) ([]flashSector, error) {
+	sectors := d.flashSectors(fw, flash.EraseSize())
+
+	var diff []flashSector
+	for _, m := range sectors {
+		match, err := d.flashSectorMatches(flash, m)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			diff = append(diff, m)
+		}
+	}
+
+	d.log("%d of %d flash sectors differ from the image", len(diff), len(sectors))
+	return diff, nil
+}
+
+/* flashWriteChanged only erases and writes the sectors that do not match the image */
+func (d *JMSHal) flashWriteChanged(flash *spiflash.Flash, fw []byte) error {
+	diff, err := d.flashDiff(flash, fw)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range diff {
+		if err := flash.EraseRange(m.addr, flash.EraseSize()); err != nil {
+			return err
+		}
+
+		for _, p := range m.parts {
+			if _, err := flash.Write(p.addr, p.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
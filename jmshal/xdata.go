@@ -1,51 +1,120 @@
 package jmshal
 
 import (
+	"bytes"
 	"encoding/binary"
+
+	"github.com/BertoldVdb/jms578flash/scsi"
 )
 
-func (d *JMSHal) xdataRead(offset uint16, buf []byte) (int, error) {
-	var cmdBuf [12]byte
-	cmdBuf[0] = 0xdf
+/* Without a probe the firmware only accepts 8-bit lengths */
+const xdataMaxDefault = 255
 
-	if len(buf) > 255 {
-		buf = buf[:255]
-	}
+/* Number of commands that are sent before waiting for the first result */
+const xdataPipelineDepth = 4
+
+/* Everything from here on is a register instead of memory */
+const xdataRegisterStart = 0x7000
 
-	cmdBuf[4] = byte(len(buf))
+func xdataCmd(offset uint16, length int, write bool) []byte {
+	cmdBuf := make([]byte, 12)
+	cmdBuf[0] = 0xdf
 
+	/* Byte 3 is only used by firmware that accepts 16-bit lengths */
+	binary.BigEndian.PutUint16(cmdBuf[3:], uint16(length))
 	binary.BigEndian.PutUint16(cmdBuf[6:], offset)
 
 	/* This is the type of memory, the command can read flash as well,
 	 * but we implement it ourselves to increase reliability */
 	cmdBuf[11] = 0xfd
+	if write {
+		cmdBuf[11] = 0xfe
+	}
+
+	return cmdBuf
+}
+
+/* xdataTransfer splits the buffer in commands of at most maxLen bytes and sends them pipelined */
+func (d *JMSHal) xdataTransfer(offset uint16, buf []byte, write bool, maxLen int) (int, error) {
+	if len(buf)+int(offset) > 0x10000 {
+		buf = buf[:(0x10000 - int(offset))]
+	}
+
+	var reqs []*scsi.Request
+	for i := 0; i < len(buf); i += maxLen {
+		end := i + maxLen
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		reqs = append(reqs, &scsi.Request{
+			Cmd:      xdataCmd(offset+uint16(i), end-i, write),
+			Data:     buf[i:end],
+			ToDevice: write,
+		})
+	}
+
+	/* The device may execute pipelined commands in any order, writes to registers must be done one by one */
+	depth := xdataPipelineDepth
+	if write && int(offset)+len(buf) > xdataRegisterStart {
+		depth = 1
+	}
 
-	if err := d.dev.Read(cmdBuf[:], &buf); err != nil {
+	if err := d.dev.Pipeline(reqs, depth); err != nil {
 		return 0, err
 	}
 
 	return len(buf), nil
 }
 
-func (d *JMSHal) xdataWrite(offset uint16, buf []byte) (int, error) {
-	var cmdBuf [12]byte
-	cmdBuf[0] = 0xdf
+/* EnableXDATAProbe allows 0xdf commands longer than 255 bytes if the firmware accepts them. The
+ * 16-bit length in byte 3 of the command has not been confirmed on hardware. */
+func (d *JMSHal) EnableXDATAProbe() {
+	d.xdataLong = true
+	d.xdataProbe()
+}
+
+/* xdataProbe checks if the firmware accepts 0xdf commands longer than 255 bytes. The probe uses
+ * the work buffers, so it only runs when the hooks that own them are installed, and restores
+ * their contents afterwards. Firmware without hooks never gets a long command. */
+func (d *JMSHal) xdataProbe() {
+	const probeAddr = 0x3600
+	const probeLen = 0x200
 
-	if len(buf) > 255 {
-		buf = buf[:255]
+	d.xdataReadMax = xdataMaxDefault
+	d.xdataWriteMax = xdataMaxDefault
+
+	if !d.xdataLong || !d.spiDMAInstalled() {
+		return
 	}
 
-	cmdBuf[4] = byte(len(buf))
+	ref := make([]byte, probeLen)
+	if _, err := d.XDATARead(probeAddr, ref); err != nil {
+		return
+	}
 
-	binary.BigEndian.PutUint16(cmdBuf[6:], offset)
+	/* Every byte differs from the reference, so a short read cannot match */
+	probe := make([]byte, probeLen)
+	for i := range probe {
+		probe[i] = ^ref[i]
+	}
 
-	cmdBuf[11] = 0xfe
+	if _, err := d.xdataTransfer(probeAddr, probe, false, probeLen); err != nil || !bytes.Equal(probe, ref) {
+		return
+	}
+	d.xdataReadMax = probeLen
 
-	if err := d.dev.Write(cmdBuf[:], buf); err != nil {
-		return 0, err
+	for i := range probe {
+		probe[i] = ^ref[i]
+	}
+	if _, err := d.xdataTransfer(probeAddr, probe, true, probeLen); err == nil {
+		check := make([]byte, probeLen)
+		if _, err := d.XDATARead(probeAddr, check); err == nil && bytes.Equal(probe, check) {
+			d.xdataWriteMax = probeLen
+		}
 	}
 
-	return len(buf), nil
+	d.XDATAWrite(probeAddr, ref)
 }
 
 func completeIO(offset uint16, buf []byte, f func(offset uint16, buf []byte) (int, error)) (int, error) {
@@ -71,11 +140,11 @@ func completeIO(offset uint16, buf []byte, f func(offset uint16, buf []byte) (in
 }
 
 func (d *JMSHal) XDATARead(offset uint16, buf []byte) (int, error) {
-	return completeIO(offset, buf, d.xdataRead)
+	return d.xdataTransfer(offset, buf, false, d.xdataReadMax)
 }
 
 func (d *JMSHal) XDATAWrite(offset uint16, buf []byte) (int, error) {
-	return completeIO(offset, buf, d.xdataWrite)
+	return d.xdataTransfer(offset, buf, true, d.xdataWriteMax)
 }
 
 func (d *JMSHal) XDATAReadByte(offset uint16) (byte, error) {
@@ -0,0 +1,141 @@
+    ; Read R7 chunks of 256 bytes from the flash and update the CRC with them
+    ;  R0:R1:R2:R3 = CRC (big endian), same algorithm as the image headers
+    ;  CMD         = read command (0x03 + address), the address is advanced for every chunk
+    ; Returns the new CRC in R0:R1:R2:R3
+    ; The command follows the 256 byte buffer, both are in the 512 bytes at 0x3700 used by the hooks
+.equ CMD, 0x3800
+.equ BUF, 0x3700
+
+nextChunk:
+    ; Load read command
+    MOV  DPTR, #CMD
+    MOV  R4, #4
+load:
+    MOVX A, @DPTR
+    INC  DPTR
+    PUSH DPL
+    PUSH DPH
+
+    MOV  DPTR, #0x7140
+    MOVX @DPTR, A
+
+    POP  DPH
+    POP  DPL
+
+    DJNZ R4, load
+
+    ; Receive 256 bytes using DMA, same as spi_rx
+    MOV  DPTR, #0x7160
+    CLR  A
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x37
+    MOVX @DPTR, A
+    INC  DPTR
+    CLR  A
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7148
+    MOVX @DPTR, A
+    INC  DPTR
+    INC  A
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7166
+    CLR  A
+    MOVX @DPTR, A
+    INC  DPTR
+    INC  A
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7142
+    MOV  A, #0x11
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x714c
+    MOV  A, #1
+    MOVX @DPTR, A
+waitRx:
+    MOVX A, @DPTR
+    JNZ  waitRx
+
+    ; Advance address
+    MOV  DPTR, #0x3802
+    MOVX A, @DPTR
+    ADD  A, #1
+    MOVX @DPTR, A
+    MOV  DPTR, #0x3801
+    MOVX A, @DPTR
+    ADDC A, #0
+    MOVX @DPTR, A
+
+    ; Relative jumps cannot reach the start of the loop from the end
+    SJMP crcStart
+loopChunk:
+    SJMP nextChunk
+
+crcStart:
+    ; The bytes of every 32-bit word are processed in reverse order
+    MOV  DPTR, #BUF
+    MOV  R4, #3
+nextByte:
+    MOV  DPL, R4
+    MOVX A, @DPTR
+    MOV  B, A
+    MOV  R5, #8
+
+nextBit:
+    ; Input bits are reflected, C = data bit ^ CRC bit 31
+    MOV  A, B
+    RRC  A
+    MOV  B, A
+    MOV  A, R0
+    JNB  ACC.7, noInvert
+    CPL  C
+noInvert:
+
+    ; Shift the CRC, bit 0 becomes the feedback bit
+    MOV  A, R3
+    RLC  A
+    MOV  R3, A
+    MOV  A, R2
+    RLC  A
+    MOV  R2, A
+    MOV  A, R1
+    RLC  A
+    MOV  R1, A
+    MOV  A, R0
+    RLC  A
+    MOV  R0, A
+
+    ; XOR with the polynomial 0x04C11DB7, bit 0 is already set
+    MOV  A, R3
+    JNB  ACC.0, noPoly
+    XRL  A, #0xB6
+    MOV  R3, A
+    MOV  A, R2
+    XRL  A, #0x1D
+    MOV  R2, A
+    MOV  A, R1
+    XRL  A, #0xC1
+    MOV  R1, A
+    MOV  A, R0
+    XRL  A, #0x04
+    MOV  R0, A
+noPoly:
+    DJNZ R5, nextBit
+
+    ; Go to the next byte of this word, or the last byte of the next word
+    MOV  A, R4
+    ANL  A, #3
+    JZ   nextWord
+    DEC  R4
+    SJMP nextByte
+nextWord:
+    MOV  A, R4
+    ADD  A, #7
+    MOV  R4, A
+    JNC  nextByte
+
+    DJNZ R7, loopChunk
+    RET
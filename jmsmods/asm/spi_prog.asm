@@ -0,0 +1,123 @@
+    ; Program a page of 256 bytes and wait for it to finish
+    ;  R1:R2:R3 = flash address (big endian, page aligned)
+    ;  R5:R4    = XDATA address of the 4 byte command slot in front of the page
+    ;  A        = status bits that indicate an error
+    ; Returns the last status in A, R7 is 0 if the page was programmed
+    MOV  B, A
+    MOV  R7, #1
+
+    ; Write enable (PIO)
+    MOV  DPTR, #0x7140
+    MOV  A, #0x06
+    MOVX @DPTR, A
+    MOV  DPTR, #0x714c
+    MOV  A, #0x01
+    MOVX @DPTR, A
+waitWREN:
+    MOVX A, @DPTR
+    JNZ  waitWREN
+
+    ; Command in front of the page data
+    MOV  DPL, R4
+    MOV  DPH, R5
+    MOV  A, #0x02
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R1
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R2
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R3
+    MOVX @DPTR, A
+
+    ; Transmit command and page using DMA, same as spi_tx
+    MOV  DPTR, #0x7020
+    MOV  A, R4
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R5
+    MOVX @DPTR, A
+    INC  DPTR
+    CLR  A
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x20
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x04
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x01
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7148
+    MOV  A, #0x04
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x01
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7166
+    MOV  A, #0x04
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, #0x01
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7142
+    MOV  A, #0x12
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x714e
+    CLR  A
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x714c
+    INC  A
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x7026
+    MOVX @DPTR, A
+
+    MOV  DPTR, #0x714c
+waitDMA:
+    MOVX A, @DPTR
+    JNZ  waitDMA
+
+    ; Poll the status register until the chip is idle
+    MOV  R6, #0
+    MOV  R0, #0
+pollStatus:
+    MOV  DPTR, #0x7140
+    MOV  A, #0x05
+    MOVX @DPTR, A
+    INC  DPTR
+    CLR  A
+    MOVX @DPTR, A
+    MOV  DPTR, #0x714c
+    MOV  A, #0x01
+    MOVX @DPTR, A
+waitStatus:
+    MOVX A, @DPTR
+    JNZ  waitStatus
+
+    MOV  DPTR, #0x7150
+    MOVX A, @DPTR
+    JNB  ACC.0, pollDone
+    DJNZ R0, pollStatus
+    DJNZ R6, pollStatus
+    RET
+
+pollDone:
+    MOV  R0, A
+    ANL  A, B
+    JNZ  failed
+
+    MOV  R7, #0
+
+failed:
+    MOV  A, R0
+    RET
+
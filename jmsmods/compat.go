@@ -0,0 +1,49 @@
+package jmsmods
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/BertoldVdb/jms578flash/image"
+)
+
+var (
+	ErrorFirmwareUnknown  = errors.New("firmware is not known, cannot check flash support")
+	ErrorFlashUnsupported = errors.New("firmware does not support this flash")
+)
+
+/* FlashCompatible checks if the firmware, with the given mods applied, can drive the flash chip */
+func FlashCompatible(fw []byte, flashID uint32, mods []Mod) error {
+	code, _, _, err := image.Extract(fw)
+	if err != nil {
+		return err
+	}
+
+	info, ok := FirmwareLookup(code)
+	if !ok {
+		return ErrorFirmwareUnknown
+	}
+
+	fix, unsupported := info.UnsupportedFlash[flashID]
+	if !unsupported {
+		for _, m := range info.SupportedFlash {
+			if m == flashID {
+				return nil
+			}
+		}
+
+		if len(info.SupportedFlash) > 0 {
+			return fmt.Errorf("%s was not tested with flash %x", info.Name, flashID)
+		}
+		return nil
+	}
+
+	for _, m := range mods {
+		/* Without writing the flash, any chip that understands the read command works */
+		if m == fix || m == ModFlashNoWrite {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w %x: %s needs mod %s", ErrorFlashUnsupported, flashID, info.Name, fix)
+}
@@ -0,0 +1,236 @@
+package jmsmods
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	_ "embed"
+)
+
+/* A CodePatch replaces bytes in the code, Address is the code address (the code starts at 0x4000) */
+type CodePatch struct {
+	Address uint16
+	Data    []byte
+
+	/* If set, the patch is only applied when the code contains these bytes */
+	Original []byte
+}
+
+/* Firmware describes a known firmware and the mods that can be applied to it */
+type Firmware struct {
+	SHA1    []byte
+	Name    string
+	Version string
+	URL     string
+
+	/* Flash chips the firmware is known to work with, an empty list means nothing was tested */
+	SupportedFlash []uint32
+
+	/* Flash chips (as listed in the spiflash table) this firmware cannot drive, with the mod that fixes it */
+	UnsupportedFlash map[uint32]Mod
+
+	/* Mods that are implemented by replacing bytes */
+	Mods map[Mod][]CodePatch
+
+	/* Where the definition comes from: builtin or the path of a database file */
+	Source string
+}
+
+type jsonPatch struct {
+	Address  string `json:"address"`
+	Data     string `json:"data"`
+	Original string `json:"original"`
+}
+
+type jsonFirmware struct {
+	SHA1    string `json:"sha1"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+
+	SupportedFlash   []string            `json:"supportedFlash"`
+	UnsupportedFlash map[string]Mod      `json:"unsupportedFlash"`
+	Mods             map[Mod][]jsonPatch `json:"mods"`
+}
+
+func parseFlashID(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid flash ID %q", id)
+	}
+	return uint32(value), nil
+}
+
+func parseCodeAddress(addr string) (uint16, error) {
+	value, err := strconv.ParseUint(addr, 0, 16)
+	if err != nil || value < 0x4000 {
+		return 0, fmt.Errorf("invalid address %q", addr)
+	}
+	return uint16(value), nil
+}
+
+func (j jsonFirmware) firmware(source string) (Firmware, error) {
+	f := Firmware{
+		Name:             j.Name,
+		Version:          j.Version,
+		URL:              j.URL,
+		UnsupportedFlash: make(map[uint32]Mod),
+		Mods:             make(map[Mod][]CodePatch),
+		Source:           source,
+	}
+
+	var err error
+	if f.SHA1, err = hex.DecodeString(j.SHA1); err != nil || len(f.SHA1) != sha1.Size {
+		return f, fmt.Errorf("%s: invalid SHA-1", j.Name)
+	}
+	if f.Name == "" {
+		return f, errors.New("entry needs a name")
+	}
+
+	for _, m := range j.SupportedFlash {
+		id, err := parseFlashID(m)
+		if err != nil {
+			return f, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		f.SupportedFlash = append(f.SupportedFlash, id)
+	}
+
+	for k, m := range j.UnsupportedFlash {
+		id, err := parseFlashID(k)
+		if err != nil {
+			return f, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		f.UnsupportedFlash[id] = m
+	}
+
+	for mod, patches := range j.Mods {
+		for _, m := range patches {
+			addr, err := parseCodeAddress(m.Address)
+			if err != nil {
+				return f, fmt.Errorf("%s: mod %s: %w", f.Name, mod, err)
+			}
+
+			p := CodePatch{Address: addr}
+			if p.Data, err = hex.DecodeString(m.Data); err != nil || len(p.Data) == 0 {
+				return f, fmt.Errorf("%s: mod %s: invalid data", f.Name, mod)
+			}
+			if p.Original, err = hex.DecodeString(m.Original); err != nil || (len(p.Original) > 0 && len(p.Original) != len(p.Data)) {
+				return f, fmt.Errorf("%s: mod %s: invalid original data", f.Name, mod)
+			}
+
+			f.Mods[mod] = append(f.Mods[mod], p)
+		}
+	}
+
+	return f, nil
+}
+
+func parseFirmwareDatabase(data []byte, source string) ([]Firmware, error) {
+	var entries []jsonFirmware
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	var result []Firmware
+	for _, m := range entries {
+		f, err := m.firmware(source)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+
+	return result, nil
+}
+
+//go:embed firmware.json
+var firmwareDatabase []byte
+
+var knownFirmware = func() []Firmware {
+	result, err := parseFirmwareDatabase(firmwareDatabase, "builtin")
+	if err != nil {
+		panic("builtin firmware database: " + err.Error())
+	}
+	return result
+}()
+
+/* LoadFirmwareDatabase reads a JSON file with firmware descriptions. They are tried before the
+ * builtin ones, so an entry with the same hash replaces the builtin definition. */
+func LoadFirmwareDatabase(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := parseFirmwareDatabase(data, path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	knownFirmware = append(loaded, knownFirmware...)
+	return nil
+}
+
+/* DefaultFirmwareDatabasePath is the database that is loaded when no other file is given */
+func DefaultFirmwareDatabasePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "jms578flash", "firmware.json")
+}
+
+/* Firmwares returns the known firmware, entries are tried in order */
+func Firmwares() []Firmware {
+	return append([]Firmware(nil), knownFirmware...)
+}
+
+/* FirmwareLookup finds the description of the code of a firmware image */
+func FirmwareLookup(code []byte) (Firmware, bool) {
+	h := sha1.Sum(code)
+	for _, m := range knownFirmware {
+		if bytes.Equal(h[:], m.SHA1) {
+			return m, true
+		}
+	}
+	return Firmware{}, false
+}
+
+/* firmwareModKnown checks if any known firmware implements the mod */
+func firmwareModKnown(m Mod) bool {
+	for _, f := range knownFirmware {
+		if _, ok := f.Mods[m]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* applyCodePatches changes the code for a mod that is described in the database */
+func applyCodePatches(code []byte, codeOffset uint16, patches []CodePatch) error {
+	for _, m := range patches {
+		start := int(m.Address) - int(codeOffset)
+		if start < 0 || start+len(m.Data) > len(code) {
+			return fmt.Errorf("patch at %04x is outside the code", m.Address)
+		}
+
+		if len(m.Original) > 0 && !bytes.Equal(code[start:start+len(m.Original)], m.Original) {
+			return fmt.Errorf("code at %04x does not match the database", m.Address)
+		}
+	}
+
+	/* Only change the code when all patches can be applied */
+	for _, m := range patches {
+		copy(code[int(m.Address)-int(codeOffset):], m.Data)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package jmsmods
+
+import (
+	"bytes"
+)
+
+/* PatchState describes the firmware and which patches of this library it contains */
+type PatchState struct {
+	/* Name of the firmware, empty if the code is not known (this includes patched code) */
+	Firmware string
+
+	Hooks       bool
+	HookVersion string
+
+	/* Number of hooks that this library can use */
+	HookCount int
+
+	/* The debug commands are disabled */
+	NoDebug bool
+}
+
+/* PatchInspect checks the code of a firmware image for the hooks and the NoDebug mod */
+func PatchInspect(code []byte) PatchState {
+	var state PatchState
+	if info, ok := FirmwareLookup(code); ok {
+		state.Firmware = info.Name
+	}
+
+	table, err := patchFindJumpTable(code)
+	if err != nil {
+		return state
+	}
+
+	/* The code of a firmware image starts at 0x4000 */
+	handler := func(t uint8) []byte {
+		for _, m := range table {
+			if addr := int(m.AddrHandler) - 0x4000; m.Type == t && addr >= 0 && addr < len(code) {
+				return code[addr:]
+			}
+		}
+		return nil
+	}
+
+	if h := handler(0xdf); h != nil && bytes.HasPrefix(h, disabledHandler) {
+		state.NoDebug = true
+	}
+
+	/* The first bytes of the hook are not changed when it is installed */
+	h := handler(0xe0)
+	hi := bytes.IndexByte(hookBinaryMain, 0xAA)
+	lo := bytes.IndexByte(hookBinaryMain, 0xBB)
+	if h == nil || len(h) < len(hookBinaryMain) || !bytes.HasPrefix(h, hookBinaryMain[:6]) {
+		return state
+	}
+	state.Hooks = true
+
+	var infoTable [128]byte
+	if addr := (int(h[hi])<<8 | int(h[lo])) - 0x4000; addr >= 0 && addr < len(code) {
+		copy(infoTable[:], code[addr:])
+	}
+
+	hooks, version := PatchReadInfo(infoTable)
+	state.HookVersion = version
+	state.HookCount = len(hooks)
+
+	return state
+}
@@ -0,0 +1,345 @@
+package jmsmods
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* A relocation writes the code address of a symbol into a patch or blob. The symbols are the
+ * names of the blobs and "signature", the address where the signature was found. */
+type modRelocation struct {
+	offset int
+	symbol string
+
+	/* abs16 (big endian, as used by LJMP, LCALL and MOV DPTR), hi8 or lo8 */
+	kind   string
+	addend int
+}
+
+type modPatch struct {
+	/* Code address, or the distance from the signature if the mod has one */
+	offset      int
+	original    []byte
+	data        []byte
+	relocations []modRelocation
+}
+
+type modBlob struct {
+	name        string
+	code        []byte
+	relocations []modRelocation
+}
+
+/* A ModFile is a mod that is described in a file instead of in the code of this library */
+type ModFile struct {
+	Name        string
+	Description string
+
+	/* Hashes of the unmodified code the mod was made for */
+	sha1 [][]byte
+
+	/* Bytes that must be found exactly once in the code, -1 matches any byte */
+	signature []int
+
+	patches []modPatch
+	blobs   []modBlob
+}
+
+type jsonRelocation struct {
+	Offset int    `json:"offset"`
+	Symbol string `json:"symbol"`
+	Type   string `json:"type"`
+	Addend int    `json:"addend"`
+}
+
+type jsonModPatch struct {
+	Offset      string           `json:"offset"`
+	Original    string           `json:"original"`
+	Data        string           `json:"data"`
+	Relocations []jsonRelocation `json:"relocations"`
+}
+
+type jsonModBlob struct {
+	Name        string           `json:"name"`
+	Code        string           `json:"code"`
+	Relocations []jsonRelocation `json:"relocations"`
+}
+
+type jsonModFile struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	SHA1        []string       `json:"sha1"`
+	Signature   string         `json:"signature"`
+	Patches     []jsonModPatch `json:"patches"`
+	Blobs       []jsonModBlob  `json:"blobs"`
+}
+
+/* isModFile decides if a mod given by the user is a file instead of a builtin name */
+func isModFile(m Mod) bool {
+	return strings.HasSuffix(string(m), ".json") || strings.ContainsRune(string(m), os.PathSeparator)
+}
+
+/* parseSignature reads hex bytes, optionally separated by spaces, with ?? as wildcard */
+func parseSignature(sig string) ([]int, error) {
+	sig = strings.ReplaceAll(sig, " ", "")
+	if len(sig)%2 != 0 {
+		return nil, errors.New("signature has an odd number of digits")
+	}
+
+	var result []int
+	for i := 0; i < len(sig); i += 2 {
+		if sig[i:i+2] == "??" {
+			result = append(result, -1)
+			continue
+		}
+
+		value, err := strconv.ParseUint(sig[i:i+2], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature byte %q", sig[i:i+2])
+		}
+		result = append(result, int(value))
+	}
+
+	return result, nil
+}
+
+func parseRelocations(relocs []jsonRelocation, length int) ([]modRelocation, error) {
+	var result []modRelocation
+	for _, m := range relocs {
+		size := 1
+		switch m.Type {
+		case "abs16":
+			size = 2
+		case "hi8", "lo8":
+		default:
+			return nil, fmt.Errorf("unknown relocation type %q", m.Type)
+		}
+
+		if m.Offset < 0 || m.Offset+size > length {
+			return nil, fmt.Errorf("relocation for %s is outside the data", m.Symbol)
+		}
+
+		result = append(result, modRelocation{offset: m.Offset, symbol: m.Symbol, kind: m.Type, addend: m.Addend})
+	}
+	return result, nil
+}
+
+/* ParseModFile reads the JSON description of a mod */
+func ParseModFile(data []byte) (*ModFile, error) {
+	var j jsonModFile
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+
+	f := &ModFile{Name: j.Name, Description: j.Description}
+	if f.Name == "" {
+		return nil, errors.New("mod needs a name")
+	}
+
+	for _, m := range j.SHA1 {
+		h, err := hex.DecodeString(m)
+		if err != nil || len(h) != 20 {
+			return nil, fmt.Errorf("%s: invalid SHA-1 %q", f.Name, m)
+		}
+		f.sha1 = append(f.sha1, h)
+	}
+
+	if j.Signature != "" {
+		var err error
+		if f.signature, err = parseSignature(j.Signature); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+
+	if len(f.sha1) == 0 && len(f.signature) == 0 {
+		return nil, fmt.Errorf("%s: mod needs a firmware hash or a signature", f.Name)
+	}
+
+	for _, m := range j.Patches {
+		offset, err := strconv.ParseInt(m.Offset, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid patch offset %q", f.Name, m.Offset)
+		}
+
+		p := modPatch{offset: int(offset)}
+		if p.data, err = hex.DecodeString(m.Data); err != nil || len(p.data) == 0 {
+			return nil, fmt.Errorf("%s: invalid data for patch at %s", f.Name, m.Offset)
+		}
+
+		/* The original bytes are required, so a mod is never applied to code it was not made for */
+		if p.original, err = hex.DecodeString(m.Original); err != nil || len(p.original) != len(p.data) {
+			return nil, fmt.Errorf("%s: the original bytes of the patch at %s are missing or have the wrong length", f.Name, m.Offset)
+		}
+
+		if p.relocations, err = parseRelocations(m.Relocations, len(p.data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+
+		f.patches = append(f.patches, p)
+	}
+
+	for _, m := range j.Blobs {
+		b := modBlob{name: m.Name}
+		if b.name == "" || b.name == "signature" {
+			return nil, fmt.Errorf("%s: blob needs a name", f.Name)
+		}
+
+		var err error
+		if b.code, err = hex.DecodeString(strings.ReplaceAll(m.Code, " ", "")); err != nil || len(b.code) == 0 {
+			return nil, fmt.Errorf("%s: invalid code for blob %s", f.Name, b.name)
+		}
+
+		if b.relocations, err = parseRelocations(m.Relocations, len(b.code)); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+
+		f.blobs = append(f.blobs, b)
+	}
+
+	return f, nil
+}
+
+/* LoadModFile reads a mod from a JSON file */
+func LoadModFile(path string) (*ModFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ParseModFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+/* Any value except 0x00 and 0xff */
+const blobTerminator = 0xa5
+
+func (f *ModFile) findSignature(code []byte) (int, error) {
+	found := -1
+	for i := 0; i+len(f.signature) <= len(code); i++ {
+		match := true
+		for j, m := range f.signature {
+			if m >= 0 && code[i+j] != byte(m) {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			if found >= 0 {
+				return 0, errors.New("signature found more than once")
+			}
+			found = i
+		}
+	}
+
+	if found < 0 {
+		return 0, errors.New("signature not found")
+	}
+	return found, nil
+}
+
+func relocate(data []byte, relocs []modRelocation, symbols map[string]int) error {
+	for _, m := range relocs {
+		addr, ok := symbols[m.symbol]
+		if !ok {
+			return fmt.Errorf("unknown symbol %s", m.symbol)
+		}
+		addr += m.addend
+
+		switch m.kind {
+		case "abs16":
+			binary.BigEndian.PutUint16(data[m.offset:], uint16(addr))
+		case "hi8":
+			data[m.offset] = byte(addr >> 8)
+		case "lo8":
+			data[m.offset] = byte(addr)
+		}
+	}
+	return nil
+}
+
+/* apply installs the mod. hash is the SHA-1 of the code before any mod was applied. The code
+ * is only changed if every patch matches. */
+func (f *ModFile) apply(code []byte, codeOffset uint16, hash []byte) error {
+	if len(f.sha1) > 0 {
+		found := false
+		for _, m := range f.sha1 {
+			found = found || bytes.Equal(m, hash)
+		}
+		if !found {
+			return fmt.Errorf("mod %s was not made for firmware with code checksum %x", f.Name, hash)
+		}
+	}
+
+	symbols := make(map[string]int)
+	base := int(codeOffset)
+	if len(f.signature) > 0 {
+		pos, err := f.findSignature(code)
+		if err != nil {
+			return fmt.Errorf("mod %s: %w", f.Name, err)
+		}
+		base = -pos
+		symbols["signature"] = pos + int(codeOffset)
+	}
+
+	/* Blobs go to the free space at the end of the code, like the hooks */
+	type write struct {
+		addr int
+		data []byte
+	}
+	var writes []write
+
+	addr := int(patchFindLoadAddress(code))
+	for _, m := range f.blobs {
+		if addr+len(m.code)+1 > len(code) {
+			return fmt.Errorf("mod %s: no space for blob %s", f.Name, m.name)
+		}
+		symbols[m.name] = addr + int(codeOffset)
+		writes = append(writes, write{addr, append([]byte(nil), m.code...)})
+		addr += len(m.code)
+	}
+
+	/* patchFindLoadAddress treats 0x00 and 0xff as free, a blob ending in these bytes would be
+	 * overwritten by the next mod or the hooks. This byte marks the end of the used space. */
+	if len(f.blobs) > 0 {
+		writes = append(writes, write{addr, []byte{blobTerminator}})
+	}
+
+	for i, m := range f.blobs {
+		if err := relocate(writes[i].data, m.relocations, symbols); err != nil {
+			return fmt.Errorf("mod %s: blob %s: %w", f.Name, m.name, err)
+		}
+	}
+
+	for _, m := range f.patches {
+		start := m.offset - base
+		if start < 0 || start+len(m.data) > len(code) {
+			return fmt.Errorf("mod %s: patch at %x is outside the code", f.Name, m.offset)
+		}
+		if !bytes.Equal(code[start:start+len(m.original)], m.original) {
+			return fmt.Errorf("mod %s: code at %04x does not contain the original bytes", f.Name, start+int(codeOffset))
+		}
+
+		data := append([]byte(nil), m.data...)
+		if err := relocate(data, m.relocations, symbols); err != nil {
+			return fmt.Errorf("mod %s: patch at %x: %w", f.Name, m.offset, err)
+		}
+		writes = append(writes, write{start, data})
+	}
+
+	for _, m := range writes {
+		copy(code[m.addr:], m.data)
+	}
+
+	return nil
+}
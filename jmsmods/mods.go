@@ -1,7 +1,6 @@
 package jmsmods
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
@@ -36,31 +35,36 @@ func notSupported(h [20]byte, m Mod) error {
 	return fmt.Errorf("mod %s not suppored on firmware with code checksum %s", m, hex.EncodeToString(h[:]))
 }
 
-// JMS578_STD_v00.04.01.04_Self Power + ODD.bin
-var JMS578_414 = []byte{0x5e, 0x67, 0x7d, 0xaa, 0xc3, 0xdc, 0x3e, 0x31, 0xa0, 0x54, 0x81, 0x13, 0xf5, 0x60, 0x51, 0xde, 0x2e, 0x1d, 0x0b, 0x51}
-
 //go:embed asm/disable.bin
 var disabledHandler []byte
 
 func modsInstall(code []byte, nvram []byte, codeOffset uint16, mods []Mod) ([]byte, []byte, error) {
 	h := sha1.Sum(code)
+	info, _ := FirmwareLookup(code)
 
 	hookImpossible := false
 
 	for _, m := range mods {
-		switch m {
-		case ModFlashNoWrite:
-			if bytes.Equal(h[:], JMS578_414) {
-				code[0x5dfb-codeOffset] = 0x22
-				continue
+		if isModFile(m) {
+			f, err := LoadModFile(string(m))
+			if err != nil {
+				return nil, nil, err
 			}
+			if err := f.apply(code, codeOffset, h[:]); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
 
-		case ModFlashSupportAT25DN512:
-			if bytes.Equal(h[:], JMS578_414) {
-				copy(code[0x5f03-codeOffset:], []byte{0x2, 0x5f, 0xc9})
-				continue
+		/* Mods that only replace bytes are described in the firmware database */
+		if patches, ok := info.Mods[m]; ok {
+			if err := applyCodePatches(code, codeOffset, patches); err != nil {
+				return nil, nil, fmt.Errorf("mod %s: %w", m, err)
 			}
+			continue
+		}
 
+		switch m {
 		case ModClearNVRAM:
 			for i := range nvram {
 				nvram[i] = 0xff
@@ -112,10 +116,12 @@ func modsInstall(code []byte, nvram []byte, codeOffset uint16, mods []Mod) ([]by
 			continue
 
 		default:
+			/* The mod exists, but not for this firmware */
+			if firmwareModKnown(m) {
+				return nil, nil, notSupported(h, m)
+			}
 			return nil, nil, fmt.Errorf("unknown mod '%s'", m)
 		}
-
-		return nil, nil, notSupported(h, m)
 	}
 
 	return code, nvram, nil
@@ -126,6 +132,9 @@ func PatchCreate(fw []byte, mods []Mod) ([]byte, error) {
 		return fw, nil
 	}
 
+	/* The mods work in place, do not change the input */
+	fw = append([]byte(nil), fw...)
+
 	code, nvram, isRam, err := image.Extract(fw)
 	if err != nil {
 		return nil, err
@@ -142,3 +151,12 @@ func PatchCreate(fw []byte, mods []Mod) ([]byte, error) {
 
 	return image.Build(code, nvram, isRam), nil
 }
+
+/* PatchCode applies the mods to the code of a flash or RAM image that will be started from RAM,
+ * there is no NVRAM to change in this case */
+func PatchCode(code []byte, mods []Mod) ([]byte, error) {
+	code = append([]byte(nil), code...)
+
+	code, _, err := modsInstall(code, nil, 0x4000, mods)
+	return code, err
+}
@@ -0,0 +1,392 @@
+package jmsmods
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+)
+
+/* Stand-in for the code of a firmware, with a few SPI commands. The vendor firmware is not part
+ * of this repository. */
+func testCode414() []byte {
+	code := make([]byte, 0xC000-8)
+	put := func(addr int, data ...byte) {
+		copy(code[addr-0x4000:], data)
+	}
+
+	put(0x5f03, 0x90, 0x71, 0x40, 0x74, 0xD8, 0xF0)
+	put(0x5fc9, 0x74, 0x20, 0x90, 0x71, 0x40, 0xF0)
+	put(0x6100, 0x74, 0xC7, 0x90, 0x71, 0x40, 0xF0)
+	put(0x6200, 0x74, 0x03, 0x90, 0x71, 0x40, 0xF0)
+
+	return code
+}
+
+func TestFlashCompatible(t *testing.T) {
+	code := testCode414()
+	h := sha1.Sum(code)
+
+	saved := knownFirmware
+	defer func() { knownFirmware = saved }()
+	knownFirmware = []Firmware{{
+		SHA1:             h[:],
+		Name:             "test",
+		UnsupportedFlash: map[uint32]Mod{0x1f65: ModFlashSupportAT25DN512},
+	}}
+
+	fw := image.Build(code, nil, false)
+	tests := []struct {
+		mods []Mod
+		ok   bool
+	}{
+		{nil, false},
+		{[]Mod{ModFlashSupportAT25DN512}, true},
+		{[]Mod{ModFlashNoWrite}, true},
+		{[]Mod{ModClearNVRAM}, false},
+		{[]Mod{"FlashSupportOther"}, false},
+	}
+
+	for _, m := range tests {
+		err := FlashCompatible(fw, 0x1f65, m.mods)
+		if m.ok && err != nil {
+			t.Errorf("Mods %v refused: %v", m.mods, err)
+		} else if !m.ok && !errors.Is(err, ErrorFlashUnsupported) {
+			t.Errorf("Mods %v accepted: %v", m.mods, err)
+		}
+	}
+
+	if err := FlashCompatible(fw, 0xef3012, nil); err != nil {
+		t.Error("Flash without known problems refused:", err)
+	}
+}
+
+func TestBuiltinFirmware(t *testing.T) {
+	known := make(map[uint32]bool)
+	for _, m := range spiflash.Devices() {
+		known[m.ID] = true
+	}
+
+	for _, f := range Firmwares() {
+		if len(f.SupportedFlash) == 0 {
+			t.Errorf("%s lists no supported flash", f.Name)
+		}
+		for _, m := range f.SupportedFlash {
+			if !known[m] {
+				t.Errorf("%s: supported flash %x is not in the chip table", f.Name, m)
+			}
+		}
+		for m := range f.UnsupportedFlash {
+			if !known[m] {
+				t.Errorf("%s: unsupported flash %x is not in the chip table", f.Name, m)
+			}
+		}
+	}
+}
+
+func TestFirmwareDatabase(t *testing.T) {
+	valid := `[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "test",
+		"supportedFlash": ["ef3012"], "unsupportedFlash": {"1f65": "FlashNoWrite"},
+		"mods": {"FlashNoWrite": [{"address": "0x5dfb", "data": "22", "original": "12"}]}}]`
+
+	db, err := parseFirmwareDatabase([]byte(valid), "test.json")
+	if err != nil {
+		t.Fatal("Valid database refused:", err)
+	}
+	if len(db) != 1 || db[0].Source != "test.json" || db[0].UnsupportedFlash[0x1f65] != ModFlashNoWrite ||
+		len(db[0].Mods[ModFlashNoWrite]) != 1 || db[0].Mods[ModFlashNoWrite][0].Address != 0x5dfb {
+		t.Errorf("Wrong database: %+v", db)
+	}
+
+	for _, m := range []string{
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b", "name": "short sha1"}]`,
+		`[{"sha1": "xx677daac3dc3e31a0548113f56051de2e1d0b51", "name": "bad sha1"}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51"}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "bad flash", "supportedFlash": ["xyz"]}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "low address", "mods": {"A": [{"address": "0x1000", "data": "22"}]}}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "bad address", "mods": {"A": [{"address": "5dfb", "data": "22"}]}}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "no data", "mods": {"A": [{"address": "0x5dfb"}]}}]`,
+		`[{"sha1": "5e677daac3dc3e31a0548113f56051de2e1d0b51", "name": "bad original", "mods": {"A": [{"address": "0x5dfb", "data": "22", "original": "1234"}]}}]`,
+	} {
+		if _, err := parseFirmwareDatabase([]byte(m), "test.json"); err == nil {
+			t.Error("Invalid database accepted:", m)
+		}
+	}
+}
+
+func TestApplyCodePatches(t *testing.T) {
+	code := testCode414()
+	orig := append([]byte(nil), code...)
+
+	patches := []CodePatch{
+		{Address: 0x5f03, Data: []byte{0x02, 0x5f, 0xc9}, Original: []byte{0x90, 0x71, 0x40}},
+		{Address: 0x6100, Data: []byte{0x22}, Original: []byte{0x75}},
+	}
+	if err := applyCodePatches(code, 0x4000, patches); err == nil {
+		t.Error("Patch with wrong original bytes accepted")
+	}
+	if !bytes.Equal(code, orig) {
+		t.Error("Code changed by refused patches")
+	}
+
+	if err := applyCodePatches(code, 0x4000, []CodePatch{{Address: 0xfffe, Data: []byte{1, 2, 3}}}); err == nil {
+		t.Error("Patch outside the code accepted")
+	}
+
+	patches[1].Original[0] = 0x74
+	if err := applyCodePatches(code, 0x4000, patches); err != nil {
+		t.Fatal("Failed to apply patches:", err)
+	}
+	if !bytes.Equal(code[0x1f03:0x1f06], patches[0].Data) || code[0x2100] != 0x22 {
+		t.Error("Patches not applied")
+	}
+}
+
+func TestLoadFirmwareDatabase(t *testing.T) {
+	code := testCode414()
+	h := sha1.Sum(code)
+
+	saved := knownFirmware
+	defer func() { knownFirmware = saved }()
+	knownFirmware = []Firmware{{SHA1: h[:], Name: "builtin", Source: "builtin"}}
+
+	path := filepath.Join(t.TempDir(), "firmware.json")
+	data := fmt.Sprintf(`[{"sha1": "%x", "name": "user", "mods": {"Test": [{"address": "0x4000", "data": "00"}]}}]`, h)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal("Failed to write database:", err)
+	}
+
+	if err := LoadFirmwareDatabase(path); err != nil {
+		t.Fatal("Failed to load database:", err)
+	}
+
+	/* The entry from the file replaces the builtin one */
+	if f, ok := FirmwareLookup(code); !ok || f.Name != "user" || f.Source != path {
+		t.Errorf("Wrong firmware found: %+v", f)
+	}
+	if len(Firmwares()) != 2 {
+		t.Error("Builtin entry removed")
+	}
+
+	/* Mods from the database, mods for other firmware and unknown mods */
+	if _, err := PatchCode(code, []Mod{"Test"}); err != nil {
+		t.Error("Mod from the database refused:", err)
+	}
+	if _, err := PatchCode(make([]byte, len(code)), []Mod{"Test"}); err == nil || strings.Contains(err.Error(), "unknown mod") {
+		t.Error("Mod for other firmware accepted:", err)
+	}
+	if _, err := PatchCode(code, []Mod{"Bogus"}); err == nil || !strings.Contains(err.Error(), "unknown mod") {
+		t.Error("Unknown mod accepted:", err)
+	}
+}
+
+func TestParseModFile(t *testing.T) {
+	valid := `{"name": "test", "signature": "90 71 ?? 74", "patches": [{"offset": "0", "original": "907140", "data": "120000",
+		"relocations": [{"offset": 1, "symbol": "fn", "type": "abs16"}]}], "blobs": [{"name": "fn", "code": "e4 22"}]}`
+
+	f, err := ParseModFile([]byte(valid))
+	if err != nil {
+		t.Fatal("Valid mod refused:", err)
+	}
+	if f.Name != "test" || len(f.signature) != 4 || f.signature[2] != -1 || len(f.patches) != 1 || len(f.blobs) != 1 {
+		t.Errorf("Wrong mod: %+v", f)
+	}
+
+	for _, m := range []string{
+		`{"name": "test", "signature": "90"`,
+		`{"signature": "90"}`,
+		`{"name": "no target"}`,
+		`{"name": "bad sha1", "sha1": ["1234"]}`,
+		`{"name": "odd signature", "signature": "907"}`,
+		`{"name": "bad signature", "signature": "9x"}`,
+		`{"name": "bad offset", "signature": "90", "patches": [{"offset": "x", "original": "90", "data": "22"}]}`,
+		`{"name": "no data", "signature": "90", "patches": [{"offset": "0", "original": "90"}]}`,
+		`{"name": "no original", "signature": "90", "patches": [{"offset": "0", "data": "22"}]}`,
+		`{"name": "short original", "signature": "90", "patches": [{"offset": "0", "original": "90", "data": "2222"}]}`,
+		`{"name": "bad type", "signature": "90", "patches": [{"offset": "0", "original": "9071", "data": "2222",
+			"relocations": [{"offset": 0, "symbol": "signature", "type": "abs8"}]}]}`,
+		`{"name": "outside", "signature": "90", "patches": [{"offset": "0", "original": "9071", "data": "2222",
+			"relocations": [{"offset": 1, "symbol": "signature", "type": "abs16"}]}]}`,
+		`{"name": "blob name", "signature": "90", "blobs": [{"code": "22"}]}`,
+		`{"name": "blob signature", "signature": "90", "blobs": [{"name": "signature", "code": "22"}]}`,
+		`{"name": "blob code", "signature": "90", "blobs": [{"name": "fn", "code": "2"}]}`,
+	} {
+		if _, err := ParseModFile([]byte(m)); err == nil {
+			t.Error("Invalid mod accepted:", m)
+		}
+	}
+}
+
+func TestFindSignature(t *testing.T) {
+	code := []byte{0x90, 0x71, 0x40, 0x74, 0x01, 0x90, 0x71, 0x41, 0x74, 0x02}
+
+	tests := []struct {
+		signature []int
+		pos       int
+	}{
+		{[]int{0x90, 0x71, 0x42}, -1},
+		{[]int{0x90, 0x71, 0x41}, 5},
+		{[]int{0x74, -1, 0x90}, 3},
+		{[]int{0x90, 0x71, -1, 0x74}, -1},
+		{[]int{0x74, 0x02, 0x00}, -1},
+	}
+
+	for _, m := range tests {
+		f := ModFile{signature: m.signature}
+		pos, err := f.findSignature(code)
+		if m.pos < 0 && err == nil {
+			t.Errorf("Signature %x found at %d", m.signature, pos)
+		} else if m.pos >= 0 && (err != nil || pos != m.pos) {
+			t.Errorf("Signature %x found at %d instead of %d: %v", m.signature, pos, m.pos, err)
+		}
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	symbols := map[string]int{"fn": 0xf123}
+
+	tests := []struct {
+		reloc  modRelocation
+		result []byte
+	}{
+		{modRelocation{offset: 1, symbol: "fn", kind: "abs16"}, []byte{0x12, 0xf1, 0x23}},
+		{modRelocation{offset: 1, symbol: "fn", kind: "abs16", addend: 0xe0}, []byte{0x12, 0xf2, 0x03}},
+		{modRelocation{offset: 0, symbol: "fn", kind: "hi8", addend: 0x100}, []byte{0xf2, 0x00, 0x00}},
+		{modRelocation{offset: 2, symbol: "fn", kind: "lo8", addend: 0x0f}, []byte{0x12, 0x00, 0x32}},
+	}
+
+	for _, m := range tests {
+		data := []byte{0x12, 0x00, 0x00}
+		if err := relocate(data, []modRelocation{m.reloc}, symbols); err != nil || !bytes.Equal(data, m.result) {
+			t.Errorf("Relocation %+v gives %x instead of %x: %v", m.reloc, data, m.result, err)
+		}
+	}
+
+	if err := relocate(make([]byte, 2), []modRelocation{{symbol: "other", kind: "abs16"}}, symbols); err == nil {
+		t.Error("Unknown symbol accepted")
+	}
+}
+
+func TestApplyModFile(t *testing.T) {
+	code := testCode414()
+	h := sha1.Sum(code)
+
+	/* The blob ends in bytes that look like free space */
+	mod := `{%s"name": "test", "signature": "74 C7 90 71 40", "patches": [
+		{"offset": "0", "original": "74c790", "data": "120000", "relocations": [{"offset": 1, "symbol": "fn", "type": "abs16"}]},
+		{"offset": "5", "original": "%s", "data": "00"}],
+		"blobs": [{"name": "fn", "code": "90 00 00 22 %s", "relocations": [{"offset": 1, "symbol": "signature", "type": "abs16", "addend": 5}]}]}`
+	zeros := strings.Repeat("00", 0x40)
+
+	tests := []struct {
+		original string
+		sha1     string
+		ok       bool
+	}{
+		{"f0", "", true},
+		{"f1", "", false},
+		{"f0", fmt.Sprintf(`"sha1": ["%x"], `, make([]byte, 20)), false},
+		{"f0", fmt.Sprintf(`"sha1": ["%x"], `, h), true},
+	}
+
+	for _, m := range tests {
+		c := append([]byte(nil), code...)
+		data := fmt.Sprintf(mod, m.sha1, m.original, zeros)
+		f, err := ParseModFile([]byte(data))
+		if err != nil {
+			t.Fatal("Mod refused:", err)
+		}
+
+		err = f.apply(c, 0x4000, h[:])
+		if !m.ok {
+			if err == nil {
+				t.Errorf("Mod %s accepted", data)
+			}
+			if !bytes.Equal(c, code) {
+				t.Errorf("Code changed by refused mod %s", data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Mod %s refused: %v", data, err)
+		}
+
+		/* The call at the signature points to the blob, the blob points back to the signature */
+		addr := int(patchFindLoadAddress(code))
+		fn := addr + 0x4000
+		if !bytes.Equal(c[0x2100:0x2103], []byte{0x12, byte(fn >> 8), byte(fn)}) || c[0x2105] != 0x00 {
+			t.Errorf("Patches not applied: %x", c[0x2100:0x2106])
+		}
+		if !bytes.Equal(c[addr:addr+4], []byte{0x90, 0x61, 0x05, 0x22}) {
+			t.Errorf("Blob not installed: %x", c[addr:addr+4])
+		}
+
+		/* Code added later must not overwrite the blob */
+		if next := int(patchFindLoadAddress(c)); next < addr+4+0x40 {
+			t.Errorf("Next load address %04x is inside the blob at %04x", next, addr)
+		}
+	}
+}
+
+func TestPatchUSBIdentity(t *testing.T) {
+	current := USBIdentity{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "JMicron", Product: "USB Disk", Serial: "0123456789AB"}
+
+	code := testCode414()
+	copy(code[0x100:], []byte{0x12, 0x01, 0x10, 0x02, 0x00, 0x00, 0x00, 0x40, 0x2d, 0x15, 0x78, 0x05, 0x01, 0x00})
+	copy(code[0x200:], usbStringDescriptor(current.Manufacturer))
+	copy(code[0x220:], usbStringDescriptor(current.Product))
+	copy(code[0x240:], usbStringDescriptor(current.Serial))
+	orig := append([]byte(nil), code...)
+
+	wanted := current
+	wanted.VendorID = 0x1234
+	wanted.Serial = "ACME-42"
+	if err := PatchUSBIdentity(code, current, wanted); err != nil {
+		t.Fatal("Failed to change descriptors:", err)
+	}
+	if !bytes.Equal(code[0x108:0x10c], []byte{0x34, 0x12, 0x78, 0x05}) {
+		t.Errorf("Wrong device descriptor: %x", code[0x100:0x112])
+	}
+
+	/* The rest of the old serial is cleared */
+	serial := append(usbStringDescriptor("ACME-42"), make([]byte, 10)...)
+	if !bytes.Equal(code[0x240:0x240+len(serial)], serial) || code[0x240+len(serial)] != 0 {
+		t.Errorf("Wrong serial descriptor: %x", code[0x240:0x260])
+	}
+	if !bytes.Equal(code[:0x100], orig[:0x100]) || !bytes.Equal(code[0x112:0x240], orig[0x112:0x240]) {
+		t.Error("Code changed outside the descriptors")
+	}
+
+	/* Nothing changes if any value cannot be changed */
+	missing := current
+	missing.Serial = "Other"
+	for _, m := range []struct {
+		current USBIdentity
+		wanted  USBIdentity
+	}{
+		{current, USBIdentity{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "JMicron", Product: "USB Disk", Serial: "0123456789ABC"}},
+		{missing, USBIdentity{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "JMicron", Product: "Disk", Serial: "Another"}},
+		{current, USBIdentity{VendorID: 0x152d, ProductID: 0x0579, Manufacturer: "JMicron", Product: "USB Disk", Serial: "0123456789AB"}},
+	} {
+		code = append([]byte(nil), orig...)
+		if m.wanted.ProductID != m.current.ProductID {
+			/* Two device descriptors */
+			copy(code[0x180:], code[0x100:0x112])
+		}
+		changed := append([]byte(nil), code...)
+
+		if err := PatchUSBIdentity(code, m.current, m.wanted); err == nil {
+			t.Errorf("Descriptors changed from %+v to %+v", m.current, m.wanted)
+		}
+		if !bytes.Equal(code, changed) {
+			t.Error("Code changed by refused change")
+		}
+	}
+}
@@ -76,14 +76,27 @@ var hookSPIReceive []byte
 //go:embed asm/spi_tx.bin
 var hookSPITransmit []byte
 
+//go:embed asm/spi_prog.bin
+var hookSPIProgram []byte
+
+//go:embed asm/spi_crc.bin
+var hookSPICRC []byte
+
 var hooks = []HookFunc{
 	{Binary: HookBinaryReset}, // USB disconnect and reset chip
 
 	{Binary: hookSPIReceive},  // SPI DMA Receive
 	{Binary: hookSPITransmit}, // SPI DMA Transmit
+	{Binary: hookSPIProgram},  // SPI page program and wait
+	{Binary: hookSPICRC},      // CRC of flash contents
 }
 
-const HookVersion string = "00.00.05" //This 8-byte string must be updated whenever the definitions change incompatibly
+const HookVersion string = "00.00.07" //This 8-byte string must be updated whenever the definitions change incompatibly
+
+/* Older hook versions that are still usable, with the number of hooks that match the current definitions */
+var hookVersionsCompatible = map[string]int{
+	"00.00.05": 3,
+}
 
 func patchFindLoadAddress(code []byte) uint16 {
 	patchLoadAddr := uint16(len(code) - 0x1a)
@@ -218,7 +231,13 @@ func PatchReadInfo(hookInfoTable [128]byte) ([]uint16, string) {
 	}
 
 	if fwHookVersion != HookVersion {
-		hookAddrs = hookAddrs[:1]
+		count, ok := hookVersionsCompatible[fwHookVersion]
+		if !ok {
+			count = 1
+		}
+		if len(hookAddrs) > count {
+			hookAddrs = hookAddrs[:count]
+		}
 	}
 
 	return hookAddrs, fwHookVersion
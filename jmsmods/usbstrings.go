@@ -0,0 +1,112 @@
+package jmsmods
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+/* USBIdentity holds the values the device reports to the host */
+type USBIdentity struct {
+	VendorID  uint16
+	ProductID uint16
+
+	Manufacturer string
+	Product      string
+	Serial       string
+}
+
+func usbStringDescriptor(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+
+	desc := make([]byte, 2+2*len(chars))
+	desc[0] = byte(len(desc))
+	desc[1] = 0x03
+	for i, m := range chars {
+		binary.LittleEndian.PutUint16(desc[2+2*i:], m)
+	}
+	return desc
+}
+
+/* findUnique returns the position of the only match of f in the code */
+func findUnique(code []byte, what string, f func(i int) bool) (int, error) {
+	found := -1
+	for i := range code {
+		if !f(i) {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("%s found more than once in the code", what)
+		}
+		found = i
+	}
+
+	if found < 0 {
+		return 0, fmt.Errorf("%s not found in the code", what)
+	}
+	return found, nil
+}
+
+/* patchUSBString replaces a string descriptor. The new string cannot be longer, the bytes after
+ * the descriptor belong to something else. */
+func patchUSBString(code []byte, name string, current string, wanted string) error {
+	if current == wanted {
+		return nil
+	}
+	if current == "" {
+		return fmt.Errorf("the device reports no %s, so it cannot be found in the code", name)
+	}
+
+	old := usbStringDescriptor(current)
+	desc := usbStringDescriptor(wanted)
+	if len(desc) > len(old) || len(desc) > 0xff {
+		return fmt.Errorf("%s %q is longer than the one in the firmware (%d characters)", name, wanted, (len(old)-2)/2)
+	}
+
+	pos, err := findUnique(code, fmt.Sprintf("%s descriptor %q", name, current), func(i int) bool {
+		return bytes.HasPrefix(code[i:], old)
+	})
+	if err != nil {
+		return err
+	}
+
+	copy(code[pos:pos+len(old)], make([]byte, len(old)))
+	copy(code[pos:], desc)
+	return nil
+}
+
+/* PatchUSBIdentity changes the USB descriptors in the code. They are found by the values the
+ * device reports now, so this only works for the firmware that is running. Every changed value
+ * must be found exactly once, otherwise the code is not changed. */
+func PatchUSBIdentity(code []byte, current USBIdentity, wanted USBIdentity) error {
+	work := append([]byte(nil), code...)
+
+	if current.VendorID != wanted.VendorID || current.ProductID != wanted.ProductID {
+		/* bLength, bDescriptorType, bcdUSB, class, subclass, protocol, bMaxPacketSize0, idVendor, idProduct */
+		pos, err := findUnique(work, "device descriptor", func(i int) bool {
+			return i+12 <= len(work) && work[i] == 0x12 && work[i+1] == 0x01 &&
+				binary.LittleEndian.Uint16(work[i+8:]) == current.VendorID &&
+				binary.LittleEndian.Uint16(work[i+10:]) == current.ProductID
+		})
+		if err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint16(work[pos+8:], wanted.VendorID)
+		binary.LittleEndian.PutUint16(work[pos+10:], wanted.ProductID)
+	}
+
+	if err := patchUSBString(work, "manufacturer", current.Manufacturer, wanted.Manufacturer); err != nil {
+		return err
+	}
+	if err := patchUSBString(work, "product", current.Product, wanted.Product); err != nil {
+		return err
+	}
+	if err := patchUSBString(work, "serial", current.Serial, wanted.Serial); err != nil {
+		return err
+	}
+
+	copy(code, work)
+	return nil
+}
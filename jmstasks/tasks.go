@@ -17,7 +17,7 @@ type JMSConfig struct {
 }
 
 func New(hal *jmshal.JMSHal) (*JMSTasks, error) {
-	flash, err := spiflash.New(hal.SPI, hal.SPIMaxTransactionSize())
+	flash, err := hal.FlashOpen()
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +29,7 @@ func New(hal *jmshal.JMSHal) (*JMSTasks, error) {
 }
 
 func (t *JMSTasks) FirmwareWrite(fw []byte) error {
-	if len(fw) < 0xc400 {
+	if len(fw) < t.hal.Layout.MinImageSize() {
 		return errors.New("firmware file too small")
 	}
 
@@ -37,18 +37,7 @@ func (t *JMSTasks) FirmwareWrite(fw []byte) error {
 		return err
 	}
 
-	if _, err := t.flash.Write(0x0e00, fw[:0x200]); err != nil {
-		return err
-	}
-	if _, err := t.flash.Write(0x0000, fw[0x200:0x400]); err != nil {
-		return err
-	}
-	if _, err := t.flash.Write(0x1000, fw[0x400:0xc400]); err != nil {
-		return err
-	}
-	_, err := t.flash.Write(0xd000, fw[0xc400:])
-
-	return err
+	return t.hal.Layout.Write(fw, t.flash.Write)
 }
 
 func (t *JMSTasks) ResetChip() error {
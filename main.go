@@ -1,14 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/BertoldVdb/jms578flash/jmshal"
 	"github.com/BertoldVdb/jms578flash/jmsmods"
 	"github.com/BertoldVdb/jms578flash/scsi"
+	"github.com/BertoldVdb/jms578flash/spiflash"
 )
 
 func readFile(path string) ([]byte, error) {
@@ -19,6 +22,22 @@ func readFile(path string) ([]byte, error) {
 	return os.ReadFile(path)
 }
 
+func checkActions(actions map[string]bool) {
+	var names []string
+	selected := 0
+	for name, set := range actions {
+		names = append(names, "-"+name)
+		if set {
+			selected++
+		}
+	}
+
+	if selected != 1 {
+		sort.Strings(names)
+		log.Fatalln("You must specify exactly one of:", strings.Join(names, ", "))
+	}
+}
+
 func main() {
 	dev := flag.String("dev", "152d:0000", "Device to use")
 	unsafe := flag.Bool("unsafe", false, "Allow writing to the flash memory")
@@ -28,26 +47,162 @@ func main() {
 	flash := flag.Bool("flash", false, "Flash given firmware to device")
 	extract := flag.Bool("extract", false, "Read current firmware form device")
 	dumprom := flag.Bool("dumprom", false, "Attempt to dump bootrom")
+	toraw := flag.Bool("toraw", false, "Convert firmware to a raw flash image for an external programmer")
+	fromraw := flag.Bool("fromraw", false, "Convert a raw flash dump to a firmware file")
+	run := flag.Bool("run", false, "Start given firmware from RAM without writing it to flash")
+	inspect := flag.Bool("inspect", false, "Show the header, checksums and patches of a firmware file")
+	fixcrc := flag.Bool("fixcrc", false, "Recalculate the checksums of a modified firmware file")
+	toram := flag.Bool("toram", false, "Convert firmware to a RAM image")
+	toflash := flag.Bool("toflash", false, "Convert firmware to a flash image")
+	split := flag.Bool("split", false, "Split firmware into code, NVRAM and metadata files")
+	join := flag.Bool("join", false, "Create firmware from the files written by -split")
+	build := flag.String("build", "", "Create firmware from Intel HEX (.hex, .ihx) or a raw binary, can be combined with -run or -flash")
+
+	chips := flag.Bool("chips", false, "Show the flash chip table and the entry matching the device")
+	info := flag.Bool("info", false, "Show information about the device and its flash")
+	protect := flag.Bool("protect", false, "Write protect the flash")
+	unprotect := flag.Bool("unprotect", false, "Remove the flash write protection")
+	program := flag.Bool("program", false, "Write a serial number (and the -vid, -pid, -manufacturer and -product values) to the USB descriptors in the firmware and verify it")
+	nvramshow := flag.Bool("nvramshow", false, "Show the NVRAM of the firmware file, or of the device if no file is given")
+
+	raw := flag.String("raw", "", "Path to raw flash image")
+	chipsize := flag.String("chipsize", "64k", "Size of the flash chip when creating a raw image")
+	output := flag.String("output", "", "Path of the converted or repaired firmware")
+	nvram := flag.String("nvram", "", "Path to NVRAM contents to put in a new flash image")
+	dropnvram := flag.Bool("dropnvram", false, "Discard the NVRAM when converting to a RAM image")
+	parts := flag.String("parts", "", "Directory for the files of -split and -join")
+	loadaddr := flag.String("loadaddr", "0x4000", "Code address of the first byte of a raw binary")
+	ramimage := flag.Bool("ramimage", false, "Create a RAM image instead of a flash image")
+
+	chipdb := flag.String("chipdb", spiflash.DefaultDatabasePath(), "Path to a JSON file with additional flash chips")
+	fwdb := flag.String("fwdb", jmsmods.DefaultFirmwareDatabasePath(), "Path to a JSON file with additional firmware descriptions")
 
 	boot := flag.Bool("boot", true, "Boot new firmware after flashing")
 	dohook := flag.Bool("hook", true, "Attempt to add hooks to loaded firmware")
-	mods := flag.String("mods", "", "Comma separated list of mods to add to the firmare")
+	mods := flag.String("mods", "", "Comma separated list of mods to add to the firmare, builtin names or paths of mod files (.json)")
+	protectafter := flag.Bool("protectafter", false, "Write protect the flash after flashing")
+	srwd := flag.Bool("srwd", false, "Also lock the protection with the WP pin when protecting the flash")
+	keepnvram := flag.Bool("keepnvram", false, "Keep the NVRAM that is in flash instead of writing the one in the firmware file")
+	serial := flag.String("serial", "", "Serial number template for -program, '%06d' is replaced by the counter and '{uid}' by the flash unique ID")
+	counter := flag.String("counter", "", "File with the next counter value for -program")
+	audit := flag.String("audit", "", "CSV file that -program adds every assignment to")
+	vid := flag.String("vid", "", "USB vendor ID for -program")
+	pid := flag.String("pid", "", "USB product ID for -program")
+	manufacturer := flag.String("manufacturer", "", "USB manufacturer string for -program")
+	product := flag.String("product", "", "USB product string for -program")
+	xdataprobe := flag.Bool("xdataprobe", false, "Use XDATA commands longer than 255 bytes if the firmware accepts them (not confirmed on hardware)")
+	force := flag.Bool("force", false, "Flash firmware even if it does not support the flash chip")
 	flag.Parse()
 
-	actions := 0
-	if *flash {
-		actions++
-	}
 	if *extract {
 		/* If we want to extract the firmware, flash should not be written, obviously */
 		*unsafe = false
-		actions++
 	}
-	if *dumprom {
-		actions++
+
+	actions := map[string]bool{
+		"flash":     *flash,
+		"extract":   *extract,
+		"dumprom":   *dumprom,
+		"toraw":     *toraw,
+		"fromraw":   *fromraw,
+		"run":       *run,
+		"inspect":   *inspect,
+		"fixcrc":    *fixcrc,
+		"toram":     *toram,
+		"toflash":   *toflash,
+		"split":     *split,
+		"join":      *join,
+		"build":     *build != "" && !*run && !*flash,
+		"chips":     *chips,
+		"info":      *info,
+		"protect":   *protect,
+		"unprotect": *unprotect,
+		"nvramshow": *nvramshow,
+		"program":   *program,
+	}
+	checkActions(actions)
+
+	if err := loadChipDatabase(*chipdb); err != nil {
+		log.Fatalln("Failed to load flash chip database:", err)
+	}
+	if err := loadFirmwareDatabase(*fwdb); err != nil {
+		log.Fatalln("Failed to load firmware database:", err)
+	}
+
+	if *chips {
+		runChips(*dev)
+		return
+	}
+
+	/* These actions only work on files */
+	if *inspect || *fixcrc {
+		if *firmware == "" {
+			log.Fatalln("Firmware filename is missing")
+		}
+
+		if *inspect {
+			runInspect(*firmware)
+		} else {
+			if *output == "" {
+				log.Fatalln("Output filename is missing, use '-output'")
+			}
+			runFixCRC(*firmware, *output)
+		}
+		return
+	}
+
+	if *toraw || *fromraw {
+		if *firmware == "" || *raw == "" {
+			log.Fatalln("Both '-firmware' and '-raw' are required")
+		}
+
+		if *toraw {
+			runToRaw(*firmware, *raw, *chipsize)
+		} else {
+			runFromRaw(*raw, *firmware)
+		}
+		return
+	}
+
+	if *nvramshow && *firmware != "" {
+		runNVRAMFile(*firmware)
+		return
+	}
+
+	if *split || *join {
+		if *firmware == "" || *parts == "" {
+			log.Fatalln("Both '-firmware' and '-parts' are required")
+		}
+
+		if *split {
+			runSplit(*firmware, *parts)
+		} else {
+			runJoin(*parts, *firmware)
+		}
+		return
+	}
+
+	if *build != "" {
+		if *firmware == "" {
+			log.Fatalln("Firmware filename is missing")
+		}
+		if *flash && *ramimage {
+			log.Fatalln("Only flash images can be written to the flash")
+		}
+
+		runBuild(*build, *loadaddr, *nvram, *ramimage, *firmware)
+		if !*run && !*flash {
+			return
+		}
 	}
-	if actions != 1 {
-		log.Fatalln("You can only specify one of '-flash','-extract' or '-dumprom'")
+
+	if *toram || *toflash {
+		if *firmware == "" || *output == "" {
+			log.Fatalln("Both '-firmware' and '-output' are required")
+		}
+
+		runConvert(*firmware, *output, *toram, *nvram, *dropnvram)
+		return
 	}
 
 	sdev, err := scsi.New(*dev)
@@ -61,6 +216,9 @@ func main() {
 	}
 
 	jms.LogFunc = log.Printf
+	if *xdataprobe {
+		jms.EnableXDATAProbe()
+	}
 
 	if *dumprom {
 		if *bootrom == "" {
@@ -79,6 +237,38 @@ func main() {
 		return
 	}
 
+	if *info {
+		runInfo(jms)
+		return
+	}
+
+	if *program {
+		runProgram(jms, sdev, programOptions{
+			serial:  *serial,
+			counter: *counter,
+			audit:   *audit,
+
+			vid:          *vid,
+			pid:          *pid,
+			manufacturer: *manufacturer,
+			product:      *product,
+		})
+		return
+	}
+
+	if *nvramshow {
+		runNVRAMDevice(jms)
+		return
+	}
+
+	if *protect || *unprotect {
+		if err := jms.FlashProtect(*protect, *srwd); err != nil {
+			log.Fatalln("Failed to change flash protection:", err)
+		}
+		runInfo(jms)
+		return
+	}
+
 	rom, err := readFile(*bootrom)
 	if err != nil {
 		log.Fatalln("Failed to load specified bootrom:", err)
@@ -108,19 +298,51 @@ func main() {
 		return
 	}
 
+	var modjms []jmsmods.Mod
+	if len(*mods) > 0 {
+		for _, m := range strings.Split(*mods, ",") {
+			modjms = append(modjms, jmsmods.Mod(m))
+		}
+	}
+
+	if *run {
+		fw, err := os.ReadFile(*firmware)
+		if err != nil {
+			log.Fatalln("Failed to read firmware:", err)
+		}
+
+		if *dohook {
+			modjms = append(modjms, jmsmods.ModAddHooks)
+		}
+
+		if err := jms.RunFirmware(fw, modjms); err != nil {
+			log.Fatalln("Failed to start firmware:", err)
+		}
+		log.Println("Firmware is running from RAM, reset or reconnect the device to start the firmware in flash")
+		return
+	}
+
 	if *flash {
 		fw, err := os.ReadFile(*firmware)
 		if err != nil {
 			log.Fatalln("Failed to read firmware:", err)
 		}
-		var modjms []jmsmods.Mod
-		if len(*mods) > 0 {
-			for _, m := range strings.Split(*mods, ",") {
-				modjms = append(modjms, jmsmods.Mod(m))
-			}
+
+		opts := jmshal.FlashOptions{
+			AddHooks:    *dohook,
+			Mods:        modjms,
+			Boot:        *boot,
+			Protect:     *protectafter,
+			ProtectSRWD: *srwd,
+
+			IgnoreCompatibility: *force,
+			KeepNVRAM:           *keepnvram,
 		}
 
-		if err := jms.FlashPatchWriteAndBootFW(rom, fw, *dohook, modjms, *boot); err != nil {
+		if err := jms.FlashPatchWriteAndBootFW(rom, fw, opts); err != nil {
+			if errors.Is(err, jmsmods.ErrorFlashUnsupported) {
+				log.Fatalln("Failed to write flash:", err, "(add the mod to -mods, or use -force to flash anyway)")
+			}
 			log.Fatalln("Failed to write flash:", err)
 		}
 		log.Println("Flash writing complete")
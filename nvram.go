@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/jmshal"
+)
+
+func showNVRAM(data []byte) {
+	if image.NVRAMErased(data) {
+		fmt.Println("NVRAM: erased, the firmware uses its defaults")
+		return
+	}
+
+	fmt.Println("NVRAM:")
+	fmt.Print(image.NVRAMDump(data))
+}
+
+func runNVRAMFile(firmware string) {
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	_, nvram, isRam, err := image.Extract(fw)
+	if err != nil {
+		log.Fatalln("Failed to parse firmware:", err)
+	}
+	if isRam {
+		log.Fatalln("RAM images have no NVRAM")
+	}
+	if len(nvram) < image.NVRAMSize {
+		fmt.Println("NVRAM: not included in the image, flashing it erases the NVRAM")
+		return
+	}
+
+	showNVRAM(nvram[:image.NVRAMSize])
+}
+
+func runNVRAMDevice(jms *jmshal.JMSHal) {
+	nvram, err := jms.NVRAMRead()
+	if err != nil {
+		log.Fatalln("Failed to read NVRAM:", err)
+	}
+
+	showNVRAM(nvram)
+}
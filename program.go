@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/jmshal"
+	"github.com/BertoldVdb/jms578flash/jmsmods"
+	"github.com/BertoldVdb/jms578flash/scsi"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+	"golang.org/x/sys/unix"
+)
+
+type programOptions struct {
+	serial  string
+	counter string
+	audit   string
+
+	/* Values to change besides the serial, empty means unchanged */
+	vid          string
+	pid          string
+	manufacturer string
+	product      string
+}
+
+/* lockCounter makes stations that share the counter file wait for each other. The lock is a
+ * separate file, the counter file itself is replaced on every update. Closing the file releases
+ * the lock. */
+func lockCounter(path string) (*os.File, error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+/* readCounter reads the decimal number in the counter file, leading zeros are allowed */
+func readCounter(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+/* writeCounter replaces the counter file, using a rename so it is never left half written */
+func writeCounter(path string, value uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", value)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/* makeSerial fills in the template. {uid} is replaced by the unique ID of the flash chip and
+ * a printf verb like %06d by the counter. */
+func makeSerial(template string, uid []byte, counter *uint64) (string, error) {
+	serial := template
+
+	if strings.Contains(serial, "{uid}") {
+		if uid == nil {
+			return "", errors.New("the flash chip has no unique ID")
+		}
+		serial = strings.ReplaceAll(serial, "{uid}", strings.ToUpper(fmt.Sprintf("%x", uid)))
+	}
+
+	if strings.Contains(serial, "%") {
+		if counter == nil {
+			return "", errors.New("the serial template needs '-counter'")
+		}
+		serial = fmt.Sprintf(serial, *counter)
+		if strings.Contains(serial, "%!") {
+			return "", fmt.Errorf("invalid serial template: %s", serial)
+		}
+	}
+
+	return serial, nil
+}
+
+/* auditWrite appends a line to the audit file, the header is written when the file is new */
+func auditWrite(path string, record []string) error {
+	_, err := os.Stat(path)
+	isNew := os.IsNotExist(err)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if isNew {
+		w.Write([]string{"time", "uid", "old serial", "serial", "vid", "pid", "manufacturer", "product", "verify"})
+	}
+	w.Write(record)
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+/* programIdentity returns the values the device should report after programming */
+func programIdentity(current jmsmods.USBIdentity, serial string, opts programOptions) (jmsmods.USBIdentity, error) {
+	wanted := current
+	wanted.Serial = serial
+
+	for _, m := range []struct {
+		name  string
+		value string
+		id    *uint16
+	}{
+		{"vid", opts.vid, &wanted.VendorID},
+		{"pid", opts.pid, &wanted.ProductID},
+	} {
+		if m.value == "" {
+			continue
+		}
+
+		value, err := strconv.ParseUint(m.value, 0, 16)
+		if err != nil {
+			return wanted, fmt.Errorf("invalid %s: %w", m.name, err)
+		}
+		*m.id = uint16(value)
+	}
+
+	if opts.manufacturer != "" {
+		wanted.Manufacturer = opts.manufacturer
+	}
+	if opts.product != "" {
+		wanted.Product = opts.product
+	}
+
+	return wanted, nil
+}
+
+/* programVerify compares what the kernel reports after the reset with the programmed values */
+func programVerify(info scsi.USBInfo, wanted jmsmods.USBIdentity) string {
+	var problems []string
+	check := func(name string, got string, want string) {
+		if got != want {
+			problems = append(problems, fmt.Sprintf("%s is %q instead of %q", name, got, want))
+		}
+	}
+
+	check("vid", fmt.Sprintf("%04x", info.VendorID), fmt.Sprintf("%04x", wanted.VendorID))
+	check("pid", fmt.Sprintf("%04x", info.ProductID), fmt.Sprintf("%04x", wanted.ProductID))
+	check("manufacturer", info.Manufacturer, wanted.Manufacturer)
+	check("product", info.Product, wanted.Product)
+	check("serial", info.Serial, wanted.Serial)
+
+	if len(problems) > 0 {
+		return "mismatch: " + strings.Join(problems, ", ")
+	}
+	return "ok"
+}
+
+func runProgram(jms *jmshal.JMSHal, sdev *scsi.SCSI, opts programOptions) {
+	if opts.serial == "" {
+		log.Fatalln("Serial template is missing")
+	}
+	if opts.audit == "" {
+		log.Fatalln("Audit filename is missing")
+	}
+
+	/* The descriptors are found in the code by the values the device reports now */
+	info, err := sdev.USBInfo()
+	if err != nil {
+		log.Fatalln("Failed to read USB information:", err)
+	}
+	current := jmsmods.USBIdentity(info)
+
+	flash, err := jms.FlashOpen()
+	if err != nil {
+		log.Fatalln("Failed to identify flash:", err)
+	}
+
+	/* Not every chip has a unique ID, this is only an error if the template uses it */
+	uid, err := flash.UniqueID()
+	if err != nil && strings.Contains(opts.serial, "{uid}") {
+		if errors.Is(err, spiflash.ErrorUniqueIDTooLong) {
+			log.Fatalln("Failed to read unique ID:", err, "(the DMA hooks are needed, use -hook)")
+		}
+		log.Fatalln("Failed to read unique ID:", err)
+	}
+
+	var counter *uint64
+	var lock *os.File
+	if opts.counter != "" {
+		/* Held until the counter is updated, the process exit releases it on errors */
+		lock, err = lockCounter(opts.counter)
+		if err != nil {
+			log.Fatalln("Failed to lock counter:", err)
+		}
+
+		value, err := readCounter(opts.counter)
+		if err != nil {
+			log.Fatalln("Failed to read counter:", err)
+		}
+		counter = &value
+	}
+
+	serial, err := makeSerial(opts.serial, uid, counter)
+	if err != nil {
+		log.Fatalln("Failed to create serial number:", err)
+	}
+
+	wanted, err := programIdentity(current, serial, opts)
+	if err != nil {
+		log.Fatalln("Failed to program device:", err)
+	}
+
+	fw, err := jms.FlashReadFirmware()
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	code, _, isRam, err := image.Extract(fw)
+	if err != nil {
+		log.Fatalln("Failed to parse firmware in flash:", err)
+	}
+	if isRam {
+		log.Fatalln("Flash contains a RAM image")
+	}
+
+	/* The code is part of fw, so this changes the image */
+	if err := jmsmods.PatchUSBIdentity(code, current, wanted); err != nil {
+		log.Fatalln("Failed to change the USB descriptors:", err)
+	}
+	image.ChecksumUpdate(fw, false)
+
+	if err := jms.FlashWriteFirmware(fw, true); err != nil {
+		log.Fatalln("Failed to write firmware:", err)
+	}
+	log.Println("Serial number", serial, "written to the firmware")
+
+	/* The serial is used now, even if the verification fails */
+	if counter != nil {
+		if err := writeCounter(opts.counter, *counter+1); err != nil {
+			log.Println("Failed to update counter:", err)
+		}
+		lock.Close()
+	}
+
+	/* Find the device by its new IDs after the reset */
+	if wanted.VendorID != current.VendorID || wanted.ProductID != current.ProductID {
+		sdev.SetUSBIDs(wanted.VendorID, wanted.ProductID)
+	}
+
+	verify := "not checked"
+	if err := jms.ResetChip(); err != nil {
+		log.Println("Failed to reset the device:", err)
+	} else if info, err := sdev.USBInfo(); err != nil {
+		log.Println("Failed to read USB information:", err)
+	} else {
+		verify = programVerify(info, wanted)
+	}
+	log.Println("Verification:", verify)
+
+	record := []string{
+		time.Now().Format(time.RFC3339),
+		fmt.Sprintf("%x", uid),
+		current.Serial,
+		wanted.Serial,
+		fmt.Sprintf("%04x", wanted.VendorID),
+		fmt.Sprintf("%04x", wanted.ProductID),
+		wanted.Manufacturer,
+		wanted.Product,
+		verify,
+	}
+	if err := auditWrite(opts.audit, record); err != nil {
+		log.Fatalln("Failed to write audit file:", err)
+	}
+
+	if verify != "ok" {
+		os.Exit(1)
+	}
+}
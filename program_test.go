@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BertoldVdb/jms578flash/jmsmods"
+	"github.com/BertoldVdb/jms578flash/scsi"
+)
+
+func TestMakeSerial(t *testing.T) {
+	counter := uint64(42)
+	uid := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	tests := []struct {
+		template string
+		uid      []byte
+		counter  *uint64
+		result   string
+	}{
+		{"FIXED", nil, nil, "FIXED"},
+		{"ACME-%06d", nil, &counter, "ACME-000042"},
+		{"ACME-{uid}", uid, nil, "ACME-DEADBEEF"},
+		{"{uid}-%d", uid, &counter, "DEADBEEF-42"},
+		{"ACME-{uid}", nil, nil, ""},
+		{"ACME-%06d", nil, nil, ""},
+		{"ACME-%s", nil, &counter, ""},
+		{"ACME-%d-%d", nil, &counter, ""},
+	}
+
+	for _, m := range tests {
+		serial, err := makeSerial(m.template, m.uid, m.counter)
+		if m.result == "" {
+			if err == nil {
+				t.Errorf("Template %q accepted: %q", m.template, serial)
+			}
+		} else if err != nil || serial != m.result {
+			t.Errorf("Template %q gives %q instead of %q: %v", m.template, serial, m.result, err)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.txt")
+
+	for _, m := range []struct {
+		data  string
+		value uint64
+		ok    bool
+	}{
+		{"123\n", 123, true},
+		{"000123", 123, true},
+		{"0x10", 0, false},
+		{"", 0, false},
+	} {
+		if err := os.WriteFile(path, []byte(m.data), 0644); err != nil {
+			t.Fatal("Failed to write counter:", err)
+		}
+
+		value, err := readCounter(path)
+		if m.ok && (err != nil || value != m.value) {
+			t.Errorf("Counter %q read as %d: %v", m.data, value, err)
+		} else if !m.ok && err == nil {
+			t.Errorf("Invalid counter %q accepted", m.data)
+		}
+	}
+
+	lock, err := lockCounter(path)
+	if err != nil {
+		t.Fatal("Failed to lock counter:", err)
+	}
+	if err := writeCounter(path, 124); err != nil {
+		t.Fatal("Failed to write counter:", err)
+	}
+	lock.Close()
+
+	if value, err := readCounter(path); err != nil || value != 124 {
+		t.Error("Wrong counter after update:", value, err)
+	}
+}
+
+func TestProgramIdentity(t *testing.T) {
+	current := jmsmods.USBIdentity{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "JMicron", Product: "USB to ATA/ATAPI Bridge", Serial: "0123456789ABCDEF"}
+
+	wanted, err := programIdentity(current, "ACME-000042", programOptions{pid: "0x1234", product: "Disk, 2TB"})
+	if err != nil {
+		t.Fatal("Failed to create identity:", err)
+	}
+	if wanted != (jmsmods.USBIdentity{VendorID: 0x152d, ProductID: 0x1234, Manufacturer: "JMicron", Product: "Disk, 2TB", Serial: "ACME-000042"}) {
+		t.Errorf("Wrong identity: %+v", wanted)
+	}
+
+	if _, err := programIdentity(current, "ACME-000042", programOptions{vid: "0x10000"}); err == nil {
+		t.Error("Invalid vendor ID accepted")
+	}
+}
+
+func TestProgramVerify(t *testing.T) {
+	wanted := jmsmods.USBIdentity{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "ACME", Product: "Disk", Serial: "ACME-000042"}
+	info := scsi.USBInfo{VendorID: 0x152d, ProductID: 0x0578, Manufacturer: "ACME", Product: "Disk", Serial: "ACME-000042"}
+
+	if result := programVerify(info, wanted); result != "ok" {
+		t.Error("Matching device not accepted:", result)
+	}
+
+	other := info
+	other.Product = "Other"
+	if result := programVerify(other, wanted); !strings.Contains(result, "product") {
+		t.Error("Wrong product accepted:", result)
+	}
+
+	other = info
+	other.Serial = "ACME-000041"
+	if result := programVerify(other, wanted); !strings.HasPrefix(result, "mismatch") || !strings.Contains(result, "serial") {
+		t.Error("Wrong serial accepted:", result)
+	}
+}
+
+func TestAuditWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.csv")
+
+	records := [][]string{
+		{"2026-01-01T00:00:00Z", "deadbeef", "", "ACME-000001", "152d", "0578", "ACME", "Disk, 2TB", "ok"},
+		{"2026-01-01T00:01:00Z", "", "old", "ACME-000002", "152d", "0578", "ACME", "Disk", "not checked"},
+	}
+	for _, m := range records {
+		if err := auditWrite(path, m); err != nil {
+			t.Fatal("Failed to write audit file:", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Failed to open audit file:", err)
+	}
+	defer file.Close()
+
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal("Failed to parse audit file:", err)
+	}
+
+	/* The header is only written once */
+	if len(lines) != 3 || lines[0][0] != "time" {
+		t.Fatalf("Wrong audit file: %q", lines)
+	}
+	for i, m := range records {
+		if strings.Join(lines[i+1], "|") != strings.Join(m, "|") {
+			t.Errorf("Wrong record %d: %q", i, lines[i+1])
+		}
+	}
+}
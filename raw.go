@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BertoldVdb/jms578flash/image"
+)
+
+func parseSize(size string) (int, error) {
+	multiplier := 1
+	if strings.HasSuffix(size, "k") || strings.HasSuffix(size, "K") {
+		multiplier = 1024
+		size = size[:len(size)-1]
+	} else if strings.HasSuffix(size, "M") {
+		multiplier = 1024 * 1024
+		size = size[:len(size)-1]
+	}
+
+	result, err := strconv.ParseUint(size, 0, 32)
+	return int(result) * multiplier, err
+}
+
+func runToRaw(firmware string, raw string, chipsize string) {
+	size, err := parseSize(chipsize)
+	if err != nil {
+		log.Fatalln("Invalid chip size:", err)
+	}
+
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	flash, err := image.DefaultFlashLayout.RawBuild(fw, size)
+	if err != nil {
+		log.Fatalln("Failed to create raw image:", err)
+	}
+
+	if err := os.WriteFile(raw, flash, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Println(len(flash), "bytes written to", raw)
+}
+
+func runFromRaw(raw string, firmware string) {
+	flash, err := os.ReadFile(raw)
+	if err != nil {
+		log.Fatalln("Failed to read raw image:", err)
+	}
+
+	fw, err := image.DefaultFlashLayout.RawExtract(flash)
+	if err != nil {
+		log.Fatalln("Failed to extract firmware:", err)
+	}
+
+	if err := os.WriteFile(firmware, fw, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Println(len(fw), "bytes written to", firmware)
+}
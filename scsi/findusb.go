@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -22,10 +23,9 @@ func readVIDPID(file string) (uint16, error) {
 	return uint16(result), err
 }
 
-func findBlockDeviceForHost(host int) (string, error) {
-	blockdev := "/sys/block/"
-
-	entries, err := os.ReadDir(blockdev)
+/* findDeviceForHost searches a sysfs class directory for the device attached to the SCSI host */
+func findDeviceForHost(dir string, host int) (string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return "", err
 	}
@@ -33,7 +33,7 @@ func findBlockDeviceForHost(host int) (string, error) {
 	for _, m := range entries {
 		name := m.Name()
 
-		dst, err := os.Readlink(path.Join(blockdev, name, "device"))
+		dst, err := os.Readlink(path.Join(dir, name, "device"))
 		if err != nil {
 			continue
 		}
@@ -59,7 +59,7 @@ func findBlockDeviceForHost(host int) (string, error) {
 		}
 	}
 
-	return "", errors.New("matching block device was not found")
+	return "", errors.New("matching device was not found")
 }
 
 func FindUSBDevices(vid uint16, pid uint16) ([]string, error) {
@@ -95,7 +95,10 @@ func FindUSBDevices(vid uint16, pid uint16) ([]string, error) {
 			continue
 		}
 
-		if dev, err := findBlockDeviceForHost(int(host)); err == nil {
+		/* The SCSI generic device allows queueing requests, it only exists if the sg driver is loaded */
+		if dev, err := findDeviceForHost("/sys/class/scsi_generic/", int(host)); err == nil {
+			results = append(results, dev)
+		} else if dev, err := findDeviceForHost("/sys/block/", int(host)); err == nil {
 			results = append(results, dev)
 		}
 	}
@@ -120,3 +123,48 @@ func isUsbPath(path string) (uint16, uint16, bool) {
 
 	return uint16(vid), uint16(pid), true
 }
+
+/* USBInfo is what the kernel reports about the USB device of a SCSI device */
+type USBInfo struct {
+	VendorID  uint16
+	ProductID uint16
+
+	Manufacturer string
+	Product      string
+	Serial       string
+}
+
+func readSysfsString(file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+/* USBInfo reads the descriptor strings of the USB device that the opened device belongs to */
+func (s *SCSI) USBInfo() (USBInfo, error) {
+	name := path.Base(s.device)
+
+	dev, err := filepath.EvalSymlinks(path.Join("/sys/class/scsi_generic", name, "device"))
+	if err != nil {
+		dev, err = filepath.EvalSymlinks(path.Join("/sys/block", name, "device"))
+	}
+	if err != nil {
+		return USBInfo{}, err
+	}
+
+	/* The SCSI device is below the target, the host and the USB interface */
+	usb := path.Join(dev, "../../../..")
+
+	var info USBInfo
+	if info.VendorID, err = readVIDPID(path.Join(usb, "idVendor")); err != nil {
+		return USBInfo{}, errors.New("device is not connected by USB")
+	}
+	info.ProductID, _ = readVIDPID(path.Join(usb, "idProduct"))
+	info.Manufacturer = readSysfsString(path.Join(usb, "manufacturer"))
+	info.Product = readSysfsString(path.Join(usb, "product"))
+	info.Serial = readSysfsString(path.Join(usb, "serial"))
+
+	return info, nil
+}
@@ -0,0 +1,160 @@
+package scsi
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const sgMajor = 21
+
+/* A Request is a single command that is sent using Pipeline */
+type Request struct {
+	Cmd  []byte
+	Data []byte
+
+	/* Data is sent to the device instead of received */
+	ToDevice bool
+
+	Err error
+
+	hdr   SGIOHdr
+	sense [32]byte
+}
+
+func (r *Request) prepare(s *SCSI, id int32) {
+	r.hdr = SGIOHdr{
+		InterfaceID:    'S',
+		SbP:            uintptr(unsafe.Pointer(&r.sense[0])),
+		Timeout:        s.Timeout,
+		MxSbLen:        uint8(len(r.sense)),
+		DxferDirection: SG_DXFER_FROM_DEV,
+		PackID:         id,
+
+		CmdLen: uint8(len(r.Cmd)),
+		CmdP:   uintptr(unsafe.Pointer(&r.Cmd[0])),
+	}
+
+	if r.ToDevice {
+		r.hdr.DxferDirection = SG_DXFER_TO_DEV
+	}
+
+	if len(r.Data) > 0 {
+		r.hdr.DxferP = uintptr(unsafe.Pointer(&r.Data[0]))
+		r.hdr.DxferLen = uint32(len(r.Data))
+	}
+}
+
+/* isGeneric checks that the file is a SCSI generic device, writing a request to a block device
+ * would overwrite its contents */
+func isGeneric(fd int) bool {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return false
+	}
+
+	return st.Mode&unix.S_IFMT == unix.S_IFCHR && unix.Major(uint64(st.Rdev)) == sgMajor
+}
+
+func hdrBytes(hdr *SGIOHdr) []byte {
+	return (*[unsafe.Sizeof(SGIOHdr{})]byte)(unsafe.Pointer(hdr))[:]
+}
+
+/* submit queues a request using write() on the sg device, it does not wait for the result */
+func (s *SCSI) submit(r *Request, id int32) error {
+	r.prepare(s, id)
+	_, err := unix.Write(s.fd, hdrBytes(&r.hdr))
+	return err
+}
+
+/* receive waits for the next finished request */
+func (s *SCSI) receive(reqs []*Request) (*Request, error) {
+	var hdr SGIOHdr
+	if _, err := unix.Read(s.fd, hdrBytes(&hdr)); err != nil {
+		return nil, err
+	}
+
+	if hdr.PackID < 0 || int(hdr.PackID) >= len(reqs) {
+		return nil, errors.New("unexpected SCSI reply")
+	}
+
+	r := reqs[hdr.PackID]
+	if hdr.Info&SG_INFO_OK_MASK != SG_INFO_OK {
+		r.Err = fmt.Errorf("SCSI Status: %08x, Host Status: %08x, Driver Status: %08x", hdr.Status, hdr.HostStatus, hdr.DriverStatus)
+	}
+
+	return r, nil
+}
+
+func (s *SCSI) pipelineSync(reqs []*Request) error {
+	for _, m := range reqs {
+		if m.ToDevice {
+			m.Err = s.Write(m.Cmd, m.Data)
+		} else {
+			m.Err = s.Read(m.Cmd, &m.Data)
+		}
+
+		if m.Err != nil {
+			return m.Err
+		}
+	}
+
+	return nil
+}
+
+/* Pipeline executes the requests with up to depth of them in flight at the same time. This
+ * only works with /dev/sg devices, otherwise the requests are executed one by one. The order
+ * in which the device executes the requests is not guaranteed. */
+func (s *SCSI) Pipeline(reqs []*Request, depth int) error {
+	if depth <= 1 || len(reqs) <= 1 || !s.async {
+		return s.pipelineSync(reqs)
+	}
+
+	submitted := 0
+	completed := 0
+	var firstErr error
+
+	for completed < len(reqs) {
+		for firstErr == nil && submitted < len(reqs) && submitted-completed < depth {
+			if err := s.submit(reqs[submitted], int32(submitted)); err != nil {
+				if submitted == 0 {
+					/* The device does not support the asynchronous interface */
+					s.async = false
+					return s.pipelineSync(reqs)
+				}
+
+				firstErr = err
+				break
+			}
+			submitted++
+		}
+
+		if completed == submitted {
+			break
+		}
+
+		r, err := s.receive(reqs)
+		if err != nil {
+			/* The requests that are still in flight would be returned to the next call, which
+			 * uses the same IDs. Closing the device discards them. */
+			if rerr := s.Reopen(); rerr != nil {
+				err = fmt.Errorf("%w (reopening the device failed: %v)", err, rerr)
+			}
+			runtime.KeepAlive(reqs)
+			return err
+		}
+		completed++
+
+		if r.Err != nil && firstErr == nil {
+			firstErr = r.Err
+		}
+	}
+
+	/* The kernel is done with the buffers now */
+	runtime.KeepAlive(reqs)
+
+	return firstErr
+}
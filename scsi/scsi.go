@@ -48,8 +48,12 @@ type SGIOHdr struct {
 
 type SCSI struct {
 	path    string
+	device  string
 	fd      int
 	Timeout uint32
+
+	/* Requests can be queued using write() and read() */
+	async bool
 }
 
 func New(path string) (*SCSI, error) {
@@ -85,8 +89,20 @@ func (s *SCSI) open() error {
 
 	var err error
 	s.fd, err = unix.Open(path, unix.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.device = path
+	s.async = isGeneric(s.fd)
+	return nil
+}
+
+/* SetUSBIDs changes the IDs that Reopen searches for, if the device was given by its USB IDs */
+func (s *SCSI) SetUSBIDs(vid uint16, pid uint16) {
+	if _, _, ok := isUsbPath(s.path); ok {
+		s.path = fmt.Sprintf("%04x:%04x", vid, pid)
+	}
 }
 
 func (s *SCSI) Reopen() error {
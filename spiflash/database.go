@@ -0,0 +1,198 @@
+package spiflash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/* DeviceInfo is the public description of a supported flash chip */
+type DeviceInfo struct {
+	ID   uint32
+	Mask uint32
+	Name string
+
+	OpcodeChipErase  uint8
+	OpcodeBlockErase uint8
+	OpcodePageErase  uint8
+
+	BlockSize     uint32
+	PageSize      uint32
+	PageEraseSize uint32
+	ChipSize      uint32
+
+	StatusVolatile          bool
+	OpcodeStatusWriteEnable uint8
+
+	/* Where the definition comes from: builtin, SFDP or the path of a database file */
+	Source string
+}
+
+func (d flashDevice) info() DeviceInfo {
+	return DeviceInfo{
+		ID:   d.deviceID,
+		Mask: d.mask,
+		Name: d.name,
+
+		OpcodeChipErase:  d.opcodeChipErase,
+		OpcodeBlockErase: d.opcodeBlockErase,
+		OpcodePageErase:  d.opcodePageErase,
+
+		BlockSize:     d.blockSize,
+		PageSize:      d.pageSize,
+		PageEraseSize: d.pageEraseBytes(),
+		ChipSize:      d.chipSize,
+
+		StatusVolatile:          d.statusVolatile,
+		OpcodeStatusWriteEnable: d.opcodeStatusWriteEnable,
+
+		Source: d.sourceName(),
+	}
+}
+
+func (d flashDevice) sourceName() string {
+	if d.source == "" {
+		return "builtin"
+	}
+	return d.source
+}
+
+/* Devices returns the table that is used to identify flash chips, entries are tried in order */
+func Devices() []DeviceInfo {
+	result := make([]DeviceInfo, len(devices))
+	for i, m := range devices {
+		result[i] = m.info()
+	}
+	return result
+}
+
+/* Numbers in the database may be written as JSON numbers or as strings like "0xC7" */
+type jsonNumber uint32
+
+func (n *jsonNumber) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		str = string(data)
+	}
+
+	value, err := strconv.ParseUint(str, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", string(data))
+	}
+
+	*n = jsonNumber(value)
+	return nil
+}
+
+type jsonDevice struct {
+	ID   jsonNumber `json:"id"`
+	Mask jsonNumber `json:"mask"`
+	Name string     `json:"name"`
+
+	OpcodeChipErase  jsonNumber `json:"opcodeChipErase"`
+	OpcodeBlockErase jsonNumber `json:"opcodeBlockErase"`
+	OpcodePageErase  jsonNumber `json:"opcodePageErase"`
+
+	BlockSize     jsonNumber `json:"blockSize"`
+	PageSize      jsonNumber `json:"pageSize"`
+	PageEraseSize jsonNumber `json:"pageEraseSize"`
+	ChipSize      jsonNumber `json:"chipSize"`
+
+	StatusVolatile          bool       `json:"statusVolatile"`
+	OpcodeStatusWriteEnable jsonNumber `json:"opcodeStatusWriteEnable"`
+	HasStatus2              bool       `json:"hasStatus2"`
+
+	StatusBPMask jsonNumber `json:"statusBPMask"`
+	StatusTBMask jsonNumber `json:"statusTBMask"`
+	ProtectUnit  jsonNumber `json:"protectUnit"`
+
+	/* Unique ID and security register family: winbond, puya or uid64 */
+	Security string `json:"security"`
+}
+
+func (j jsonDevice) device(source string) (flashDevice, error) {
+	d := flashDevice{
+		deviceID: uint32(j.ID),
+		mask:     uint32(j.Mask),
+		name:     j.Name,
+
+		opcodeChipErase:  uint8(j.OpcodeChipErase),
+		opcodeBlockErase: uint8(j.OpcodeBlockErase),
+		opcodePageErase:  uint8(j.OpcodePageErase),
+
+		blockSize:     uint32(j.BlockSize),
+		pageSize:      uint32(j.PageSize),
+		pageEraseSize: uint32(j.PageEraseSize),
+		chipSize:      uint32(j.ChipSize),
+
+		statusVolatile:          j.StatusVolatile,
+		opcodeStatusWriteEnable: uint8(j.OpcodeStatusWriteEnable),
+		hasStatus2:              j.HasStatus2,
+
+		statusBPMask: uint8(j.StatusBPMask),
+		statusTBMask: uint8(j.StatusTBMask),
+		protectUnit:  uint32(j.ProtectUnit),
+
+		source: source,
+	}
+
+	if j.Security != "" {
+		if d.security = securityFamilies[j.Security]; d.security == nil {
+			return d, fmt.Errorf("%s: unknown security family %s", d.name, j.Security)
+		}
+	}
+
+	if d.deviceID == 0 || d.name == "" {
+		return d, errors.New("entry needs an id and a name")
+	}
+	if d.opcodeChipErase == 0 || d.opcodeBlockErase == 0 || d.opcodePageErase == 0 {
+		return d, fmt.Errorf("%s: all erase opcodes are required", d.name)
+	}
+	if d.pageSize == 0 || d.pageSize&(d.pageSize-1) != 0 {
+		return d, fmt.Errorf("%s: page size must be a power of two", d.name)
+	}
+	if d.blockSize == 0 || d.chipSize < d.blockSize {
+		return d, fmt.Errorf("%s: invalid block or chip size", d.name)
+	}
+
+	return d, nil
+}
+
+/* LoadDatabase reads a JSON file with a list of chips. They are tried before the builtin ones,
+ * so an entry with the same ID replaces the builtin definition. */
+func LoadDatabase(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries []jsonDevice
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var loaded []flashDevice
+	for _, m := range entries {
+		d, err := m.device(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		loaded = append(loaded, d)
+	}
+
+	devices = append(loaded, devices...)
+	return nil
+}
+
+/* DefaultDatabasePath is the database that is loaded when no other file is given */
+func DefaultDatabasePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "jms578flash", "chips.json")
+}
@@ -0,0 +1,129 @@
+package spiflash
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	ErrorOutOfRange = errors.New("access beyond end of flash")
+	ErrorUnaligned  = errors.New("erase is not aligned to an erase block")
+)
+
+func (f *Flash) checkRange(offset uint32, length uint32) error {
+	if uint64(offset)+uint64(length) > uint64(f.device.chipSize) {
+		return ErrorOutOfRange
+	}
+	return nil
+}
+
+func (f *Flash) ChipSize() uint32 {
+	return f.device.chipSize
+}
+
+/* EraseSize returns the smallest area that can be erased */
+func (f *Flash) EraseSize() uint32 {
+	if size := f.device.pageEraseBytes(); size < f.device.blockSize {
+		return size
+	}
+	return f.device.blockSize
+}
+
+type eraseOp struct {
+	size  uint32
+	erase func(address uint32) error
+}
+
+/* EraseRange erases the given area using the largest erase commands that fit */
+func (f *Flash) EraseRange(offset uint32, length uint32) error {
+	if err := f.checkRange(offset, length); err != nil {
+		return err
+	}
+
+	unit := f.EraseSize()
+	if offset%unit != 0 || length%unit != 0 {
+		return ErrorUnaligned
+	}
+
+	ops := []eraseOp{
+		{size: f.device.chipSize, erase: func(uint32) error { return f.EraseChip() }},
+		{size: f.device.pageEraseBytes(), erase: f.ErasePage},
+		{size: f.device.blockSize, erase: f.EraseBlock},
+	}
+	if ops[1].size < ops[2].size {
+		ops[1], ops[2] = ops[2], ops[1]
+	}
+
+	for length > 0 {
+		for _, m := range ops {
+			if offset%m.size != 0 || m.size > length {
+				continue
+			}
+
+			if err := m.erase(offset); err != nil {
+				return err
+			}
+
+			offset += m.size
+			length -= m.size
+			break
+		}
+	}
+
+	return nil
+}
+
+/* Update overwrites the given area, erasing and restoring the surrounding data when needed */
+func (f *Flash) Update(offset uint32, data []byte) (int, error) {
+	if err := f.checkRange(offset, uint32(len(data))); err != nil {
+		return 0, err
+	}
+
+	unit := f.EraseSize()
+	current := make([]byte, unit)
+	written := 0
+
+	for len(data) > 0 {
+		start := offset - offset%unit
+		n := int(start + unit - offset)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		if _, err := f.Read(start, current); err != nil {
+			return written, err
+		}
+
+		part := current[offset-start : int(offset-start)+n]
+
+		if !bytes.Equal(part, data[:n]) {
+			/* Programming can only clear bits */
+			needErase := false
+			for i, m := range data[:n] {
+				if part[i]&m != m {
+					needErase = true
+					break
+				}
+			}
+
+			copy(part, data[:n])
+
+			if needErase {
+				if err := f.EraseRange(start, unit); err != nil {
+					return written, err
+				}
+				if _, err := f.Write(start, current); err != nil {
+					return written, err
+				}
+			} else if _, err := f.Write(offset, data[:n]); err != nil {
+				return written, err
+			}
+		}
+
+		offset += uint32(n)
+		data = data[n:]
+		written += n
+	}
+
+	return written, nil
+}
@@ -9,11 +9,24 @@ import (
 
 type SPIFunc func(out []byte, in []byte) error
 
+/* PageProgramFunc programs whole pages and waits until the chip is done, errorMask contains
+ * the status bits that indicate a failed operation. It returns the number of bytes written. */
+type PageProgramFunc func(offset uint32, data []byte, errorMask uint8) (int, error)
+
+var (
+	ErrorProgramFailed = errors.New("program operation failed")
+	ErrorTimeout       = errors.New("timeout")
+)
+
 type Flash struct {
 	spi SPIFunc
 
+	pageProgram    PageProgramFunc
+	pageProgramMax int
+
 	deviceID [4]byte
 	device   flashDevice
+	warnings []string
 
 	maxBytesPerTransaction int
 }
@@ -35,24 +48,65 @@ func New(spi SPIFunc, maxBytesPerTransaction int) (*Flash, error) {
 }
 
 func (f *Flash) readDeviceID() error {
+	f.warnings = nil
+
 	if err := f.spi([]byte{0x9F}, f.deviceID[:]); err != nil {
 		return err
 	}
 
 	t := binary.BigEndian.Uint32(f.deviceID[:])
-	var ok bool
-	f.device, ok = deviceLookup(t)
-	if !ok {
+	if device, ok := deviceLookup(t); ok {
+		f.device = device
+		return nil
+	}
+
+	/* Most chips describe themselves, use this for chips that are not in the table */
+	sfdp, err := f.sfdpDevice(t)
+	if err != nil {
+		if err != ErrorNoSFDP {
+			f.warnings = append(f.warnings, "failed to read SFDP: "+err.Error())
+		}
 		return fmt.Errorf("unsupported flash type: %08x", t)
 	}
 
+	f.device = sfdp
 	return nil
 }
 
+/* CheckSFDP compares the table entry of the chip with the parameters it reports using SFDP.
+ * It returns a description of every difference. */
+func (f *Flash) CheckSFDP() ([]string, error) {
+	t := binary.BigEndian.Uint32(f.deviceID[:])
+	sfdp, err := f.sfdpDevice(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, m := range sfdpCompare(f.device, sfdp) {
+		result = append(result, f.device.name+" does not match SFDP, "+m)
+	}
+	return result, nil
+}
+
 func (f *Flash) DeviceID() [4]byte {
 	return f.deviceID
 }
 
+func (f *Flash) Name() string {
+	return f.device.name
+}
+
+/* Device returns the definition that was used for the detected chip */
+func (f *Flash) Device() DeviceInfo {
+	return f.device.info()
+}
+
+/* Warnings returns the problems that were found while identifying the chip */
+func (f *Flash) Warnings() []string {
+	return f.warnings
+}
+
 func (f *Flash) writeEnable() error {
 	return f.spi([]byte{0x6}, nil)
 }
@@ -70,14 +124,14 @@ func (f *Flash) waitIdle(maxDuration time.Duration) error {
 			return err
 		} else {
 			if status&1 == 0 {
-				if status&(1<<5) > 0 {
-					return errors.New("program operation failed")
+				if status&f.device.statusErrorMask() > 0 {
+					return ErrorProgramFailed
 				}
 				return nil
 			}
 		}
 	}
-	return errors.New("timeout")
+	return ErrorTimeout
 }
 
 func (f *Flash) EraseChip() error {
@@ -93,14 +147,21 @@ func (f *Flash) EraseChip() error {
 	return err
 }
 
-func (f *Flash) ErasePage(address uint32) error {
+func (f *Flash) erase(opcode uint8, address uint32, size uint32) error {
+	if address%size != 0 {
+		return ErrorUnaligned
+	}
+	if err := f.checkRange(address, size); err != nil {
+		return err
+	}
+
 	if err := f.writeEnable(); err != nil {
 		return err
 	}
 
 	var cmd [4]byte
 	binary.BigEndian.PutUint32(cmd[:], address)
-	cmd[0] = f.device.opcodePageErase
+	cmd[0] = opcode
 
 	if err := f.spi(cmd[:], nil); err != nil {
 		return err
@@ -110,7 +171,53 @@ func (f *Flash) ErasePage(address uint32) error {
 	return err
 }
 
+func (f *Flash) ErasePage(address uint32) error {
+	return f.erase(f.device.opcodePageErase, address, f.device.pageEraseBytes())
+}
+
+func (f *Flash) EraseBlock(address uint32) error {
+	return f.erase(f.device.opcodeBlockErase, address, f.device.blockSize)
+}
+
+/* SetPageProgram installs a faster way to program up to maxBytes of whole pages at once */
+func (f *Flash) SetPageProgram(p PageProgramFunc, maxBytes int) {
+	f.pageProgram = p
+	f.pageProgramMax = maxBytes
+}
+
+func isErased(data []byte) bool {
+	for _, m := range data {
+		if m != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+/* writePages programs the full pages at the start of data using the page program function.
+ * Erased pages are left to the normal write path, which skips them. */
+func (f *Flash) writePages(offset uint32, data []byte) (int, error) {
+	pageSize := int(f.device.pageSize)
+	if f.pageProgram == nil || pageSize == 0 || offset%f.device.pageSize != 0 {
+		return 0, nil
+	}
+
+	length := 0
+	for length+pageSize <= len(data) && length+pageSize <= f.pageProgramMax && !isErased(data[length:length+pageSize]) {
+		length += pageSize
+	}
+	if length == 0 {
+		return 0, nil
+	}
+
+	return f.pageProgram(offset, data[:length], f.device.statusErrorMask())
+}
+
 func (f *Flash) write(offset uint32, data []byte) (int, error) {
+	if n, err := f.writePages(offset, data); n > 0 || err != nil {
+		return n, err
+	}
+
 	/* Do not write over page boundary */
 	maxLen := pageCrossLength(offset, uint32(len(data)), f.device.pageSize)
 	if len(data) > maxLen {
@@ -164,7 +271,12 @@ func (f *Flash) write(offset uint32, data []byte) (int, error) {
 	return skippedFront + skippedEnd + len(data), nil
 }
 
+/* Write programs data to flash that is already erased, use Update to overwrite existing data */
 func (f *Flash) Write(offset uint32, data []byte) (int, error) {
+	if err := f.checkRange(offset, uint32(len(data))); err != nil {
+		return 0, err
+	}
+
 	return completeIO(offset, data, f.write)
 }
 
@@ -185,5 +297,9 @@ func (f *Flash) read(offset uint32, data []byte) (int, error) {
 }
 
 func (f *Flash) Read(offset uint32, data []byte) (int, error) {
+	if err := f.checkRange(offset, uint32(len(data))); err != nil {
+		return 0, err
+	}
+
 	return completeIO(offset, data, f.read)
 }
@@ -0,0 +1,401 @@
+package spiflash_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/jms578flash/image"
+	"github.com/BertoldVdb/jms578flash/spiflash"
+	"github.com/BertoldVdb/jms578flash/spiflash/flashsim"
+)
+
+func newW25X20() *flashsim.Flash {
+	return flashsim.New(flashsim.Config{
+		JEDECID: []byte{0xef, 0x30, 0x12},
+		Size:    256 * 1024,
+	})
+}
+
+func getRandomBuf(length int) []byte {
+	out := make([]byte, length)
+	rand.Read(out)
+	return out
+}
+
+func TestDetect(t *testing.T) {
+	flash, err := spiflash.New(newW25X20().SPI, 16)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if flash.Name() != "Winbond W25X20" {
+		t.Error("Wrong flash detected:", flash.Name())
+	}
+
+	unknown := flashsim.New(flashsim.Config{JEDECID: []byte{0x12, 0x34, 0x56}, Size: 64 * 1024})
+	if _, err := spiflash.New(unknown.SPI, 16); err == nil {
+		t.Error("Unknown flash without SFDP accepted")
+	}
+}
+
+func makeSFDP(size int, pageSize int) []byte {
+	sfdp := make([]byte, 0x30+16*4)
+	copy(sfdp, "SFDP")
+	sfdp[6] = 0 // One parameter header
+	sfdp[7] = 0xff
+
+	/* Basic flash parameter table */
+	copy(sfdp[8:], []byte{0x00, 0x06, 0x01, 16, 0x30, 0x00, 0x00, 0xff})
+
+	dw := make([]uint32, 16)
+	dw[0] = 0xFFF920E5
+	dw[1] = uint32(size*8 - 1)
+	dw[7] = 0x520F200C
+	dw[8] = 0x0000D810
+	dw[10] = uint32(pageSize) << 4
+	for i, m := range dw {
+		binary.LittleEndian.PutUint32(sfdp[0x30+4*i:], m)
+	}
+
+	return sfdp
+}
+
+func TestSFDP(t *testing.T) {
+	sim := flashsim.New(flashsim.Config{
+		JEDECID: []byte{0x12, 0x34, 0x56},
+		Size:    128 * 1024,
+		SFDP:    makeSFDP(128*1024, 8),
+	})
+
+	flash, err := spiflash.New(sim.SPI, 16)
+	if err != nil {
+		t.Fatal("Failed to detect flash using SFDP:", err)
+	}
+
+	d := flash.Device()
+	if d.ChipSize != 128*1024 || d.BlockSize != 4096 || d.OpcodeBlockErase != 0x20 || d.PageEraseSize != 64*1024 || d.PageSize != 256 {
+		t.Errorf("Wrong parameters from SFDP: %+v", d)
+	}
+
+	/* A known chip that reports other parameters should cause a warning */
+	flash, err = spiflash.New(flashsim.New(flashsim.Config{
+		JEDECID: []byte{0xef, 0x30, 0x12},
+		Size:    256 * 1024,
+		SFDP:    makeSFDP(512*1024, 8),
+	}).SPI, 16)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if len(flash.Warnings()) != 0 {
+		t.Error("SFDP should only be used for unknown chips:", flash.Warnings())
+	}
+
+	diff, err := flash.CheckSFDP()
+	if err != nil {
+		t.Fatal("Failed to compare SFDP:", err)
+	}
+	if len(diff) != 1 {
+		t.Error("Expected one difference:", diff)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	sim := newW25X20()
+
+	for _, maxTxfr := range []int{16, 512} {
+		flash, err := spiflash.New(sim.SPI, maxTxfr)
+		if err != nil {
+			t.Fatal("Failed to detect flash:", err)
+		}
+
+		if err := flash.EraseChip(); err != nil {
+			t.Fatal("Failed to erase chip:", err)
+		}
+
+		data := getRandomBuf(3000)
+		if _, err := flash.Write(0x1234, data); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+
+		if !bytes.Equal(sim.Memory[0x1234:0x1234+len(data)], data) {
+			t.Error("Flash contents are wrong")
+		}
+
+		read := make([]byte, len(data))
+		if _, err := flash.Read(0x1234, read); err != nil {
+			t.Fatal("Failed to read:", err)
+		}
+
+		if !bytes.Equal(read, data) {
+			t.Error("Read data is wrong")
+		}
+
+		if _, err := flash.Read(256*1024-10, read); err != spiflash.ErrorOutOfRange {
+			t.Error("Read beyond end of flash accepted:", err)
+		}
+		if _, err := flash.Write(256*1024-10, data); err != spiflash.ErrorOutOfRange {
+			t.Error("Write beyond end of flash accepted:", err)
+		}
+	}
+}
+
+func TestEraseUpdate(t *testing.T) {
+	sim := newW25X20()
+	for i := range sim.Memory {
+		sim.Memory[i] = 0
+	}
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if err := flash.EraseRange(0x1000, 0x20000); err != nil {
+		t.Fatal("Failed to erase:", err)
+	}
+	if sim.Memory[0xfff] != 0 || sim.Memory[0x1000] != 0xff || sim.Memory[0x20fff] != 0xff || sim.Memory[0x21000] != 0 {
+		t.Error("Wrong area erased")
+	}
+
+	/* 16 sector erases for the start and end, and one large block in between */
+	if sim.EraseCount != 17 {
+		t.Error("Unexpected number of erase operations:", sim.EraseCount)
+	}
+
+	if err := flash.EraseRange(0x1001, 0x1000); err != spiflash.ErrorUnaligned {
+		t.Error("Unaligned erase accepted:", err)
+	}
+
+	data := getRandomBuf(0x1800)
+	if _, err := flash.Update(0x800, data); err != nil {
+		t.Fatal("Failed to update:", err)
+	}
+
+	if !bytes.Equal(sim.Memory[0x800:0x2000], data) || sim.Memory[0x7ff] != 0 || sim.Memory[0x2000] != 0xff {
+		t.Error("Update did not preserve surrounding data")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	sim := newW25X20()
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	sim.StuckZero = map[int]uint8{0x10: 0x01}
+	if _, err := flash.Update(0x10, []byte{0xff}); err != nil {
+		t.Fatal("Failed to update:", err)
+	}
+	read := make([]byte, 1)
+	flash.Read(0x10, read)
+	if read[0] != 0xfe {
+		t.Error("Stuck bit not simulated")
+	}
+}
+
+func TestTiming(t *testing.T) {
+	sim := flashsim.New(flashsim.Config{
+		JEDECID:     []byte{0x1f, 0x65, 0x01},
+		Size:        64 * 1024,
+		ProgramTime: 2 * time.Millisecond,
+		ErrorBit:    1 << 5,
+	})
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if _, err := flash.Write(0, []byte{1, 2, 3}); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	if sim.StatusPolls < 2 {
+		t.Error("Busy status was not polled")
+	}
+
+	/* The AT25DN512 reports program errors in bit 5 */
+	sim.FailPrograms = 1
+	if _, err := flash.Write(0x100, []byte{1, 2, 3}); err == nil {
+		t.Error("Program failure not reported")
+	}
+
+	sim.StuckBusy = true
+	if _, err := flash.Write(0x200, []byte{1, 2, 3}); err == nil {
+		t.Error("Timeout not reported")
+	}
+}
+
+func TestProtect(t *testing.T) {
+	sim := newW25X20()
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if err := flash.Protect(true); err != nil {
+		t.Fatal("Failed to protect:", err)
+	}
+
+	status, _ := flash.StatusRead()
+	if start, length := flash.ProtectedRange(status); start != 0 || length != 256*1024 || !status.WriteDisabled() {
+		t.Error("Wrong protection:", status)
+	}
+
+	flash.Write(0, []byte{0})
+	if sim.Memory[0] != 0xff {
+		t.Error("Protected flash was written")
+	}
+
+	sim.WPLow = true
+	if err := flash.Unprotect(); err != spiflash.ErrorStatusLocked {
+		t.Error("Locked status register was written:", err)
+	}
+
+	sim.WPLow = false
+	if err := flash.SetProtection(1, false); err != nil {
+		t.Fatal("Failed to change protection:", err)
+	}
+
+	status, _ = flash.StatusRead()
+	if start, length := flash.ProtectedRange(status); start != 192*1024 || length != 64*1024 {
+		t.Error("Wrong protected range:", start, length)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	sim := newW25X20()
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	fw := image.Build(getRandomBuf(0xc000-8), getRandomBuf(0x200), false)
+	if err := image.DefaultFlashLayout.Write(fw, flash.Write); err != nil {
+		t.Fatal("Failed to write layout:", err)
+	}
+
+	raw, err := image.DefaultFlashLayout.RawBuild(fw, len(sim.Memory))
+	if err != nil {
+		t.Fatal("Failed to build raw image:", err)
+	}
+	if !bytes.Equal(raw, sim.Memory) {
+		t.Error("Flash contents do not match raw image")
+	}
+
+	fw2, err := image.DefaultFlashLayout.Read(flash.Read)
+	if err != nil {
+		t.Fatal("Failed to read layout:", err)
+	}
+	if !bytes.Equal(fw, fw2) {
+		t.Error("Image read from flash is not equal to the input")
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	uid := getRandomBuf(16)
+	sim := flashsim.New(flashsim.Config{
+		JEDECID:              []byte{0x85, 0x40, 0x12, 0x85},
+		Size:                 256 * 1024,
+		UniqueID:             uid,
+		SecurityRegisters:    3,
+		SecurityRegisterSize: 512,
+	})
+
+	flash, err := spiflash.New(sim.SPI, 16)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if _, err := flash.UniqueID(); !errors.Is(err, spiflash.ErrorUniqueIDTooLong) {
+		t.Error("Unique ID read with too small transactions:", err)
+	}
+
+	flash, err = spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	if id, err := flash.UniqueID(); err != nil || !bytes.Equal(id, uid) {
+		t.Error("Wrong unique ID:", id, err)
+	}
+
+	data := getRandomBuf(300)
+	if _, err := flash.SecurityProgram(1, 100, data); err != nil {
+		t.Fatal("Failed to program security register:", err)
+	}
+
+	read := make([]byte, len(data))
+	if _, err := flash.SecurityRead(1, 100, read); err != nil || !bytes.Equal(read, data) {
+		t.Error("Security register contents are wrong:", err)
+	}
+
+	if _, err := flash.SecurityRead(1, 300, read); err != spiflash.ErrorOutOfRange {
+		t.Error("Read beyond end of security register accepted:", err)
+	}
+
+	if err := flash.SecurityLock(1); err != nil {
+		t.Fatal("Failed to lock security register:", err)
+	}
+	if locked, _ := flash.SecurityLocked(0); locked {
+		t.Error("Wrong security register locked")
+	}
+
+	if err := flash.SecurityErase(1); err != nil {
+		t.Fatal("Failed to erase security register:", err)
+	}
+	if !bytes.Equal(sim.Security[1][100:400], data) {
+		t.Error("Locked security register was erased")
+	}
+}
+
+func TestPageProgram(t *testing.T) {
+	sim := newW25X20()
+
+	flash, err := spiflash.New(sim.SPI, 512)
+	if err != nil {
+		t.Fatal("Failed to detect flash:", err)
+	}
+
+	/* Program the pages one by one using the simulator, like the hook does on the device */
+	calls := 0
+	flash.SetPageProgram(func(offset uint32, data []byte, errorMask uint8) (int, error) {
+		calls++
+		if offset%256 != 0 || len(data)%256 != 0 || len(data) > 512 {
+			t.Errorf("Invalid page program: %x, %d bytes", offset, len(data))
+		}
+
+		for i := 0; i < len(data); i += 256 {
+			cmd := []byte{0x02, byte((offset + uint32(i)) >> 16), byte((offset + uint32(i)) >> 8), 0}
+			sim.SPI([]byte{0x06}, nil)
+			sim.SPI(append(cmd, data[i:i+256]...), nil)
+		}
+		return len(data), nil
+	}, 512)
+
+	data := getRandomBuf(0x1000)
+	for i := 0x480; i < 0x580; i++ {
+		data[i] = 0xff
+	}
+
+	if _, err := flash.Write(0x10080, data); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+
+	if !bytes.Equal(sim.Memory[0x10080:0x11080], data) {
+		t.Error("Flash contents are wrong")
+	}
+
+	/* The unaligned start and end and the erased page are written normally */
+	if calls != 7 {
+		t.Error("Unexpected number of page program calls:", calls)
+	}
+}
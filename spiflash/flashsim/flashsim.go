@@ -0,0 +1,371 @@
+package flashsim
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	/* Bytes returned by the JEDEC ID command (0x9F) */
+	JEDECID []byte
+
+	Size     int
+	PageSize int
+
+	/* Contents of the SFDP area, nil if the chip does not support SFDP */
+	SFDP []byte
+
+	/* How long the chip stays busy after each operation */
+	ProgramTime   time.Duration
+	EraseTime     time.Duration
+	ChipEraseTime time.Duration
+
+	/* Status bit that is set when an operation fails, 0 if the chip does not report errors */
+	ErrorBit uint8
+
+	/* Size of the area protected by the lowest block protect value */
+	ProtectUnit int
+
+	/* Returned by the unique ID command (0x4B), after four dummy bytes */
+	UniqueID []byte
+
+	/* Number and size of the security registers at 0x1000, 0x2000, ... */
+	SecurityRegisters    int
+	SecurityRegisterSize int
+}
+
+var ErrorUnknownCommand = errors.New("unknown command")
+
+type Flash struct {
+	cfg Config
+
+	/* The contents of the flash, can be changed directly */
+	Memory []byte
+
+	/* The security registers, locked using the LB bits in SR2 */
+	Security [][]byte
+
+	SR1 uint8
+	SR2 uint8
+
+	busyUntil time.Time
+
+	/* Fault injection: bits that read as zero, number of program or erase operations that will
+	 * fail and a chip that never finishes its operation */
+	StuckZero    map[int]uint8
+	FailPrograms int
+	FailErases   int
+	StuckBusy    bool
+
+	/* The WP pin is low, status register writes are refused if SRWD is set */
+	WPLow bool
+
+	/* Counters that can be used by tests */
+	Commands     int
+	StatusPolls  int
+	ProgramCount int
+	EraseCount   int
+}
+
+const (
+	statusBusy = 1 << 0
+	statusWEL  = 1 << 1
+	statusBP   = 0x1c
+	statusSRWD = 1 << 7
+
+	status2LB = 0x38
+)
+
+func New(cfg Config) *Flash {
+	if cfg.PageSize == 0 {
+		cfg.PageSize = 256
+	}
+	if cfg.ProtectUnit == 0 {
+		cfg.ProtectUnit = 64 * 1024
+	}
+
+	f := &Flash{
+		cfg:    cfg,
+		Memory: make([]byte, cfg.Size),
+	}
+
+	for i := range f.Memory {
+		f.Memory[i] = 0xff
+	}
+
+	for i := 0; i < cfg.SecurityRegisters; i++ {
+		reg := make([]byte, cfg.SecurityRegisterSize)
+		for k := range reg {
+			reg[k] = 0xff
+		}
+		f.Security = append(f.Security, reg)
+	}
+
+	return f
+}
+
+func (f *Flash) busy() bool {
+	return f.StuckBusy || time.Now().Before(f.busyUntil)
+}
+
+func (f *Flash) status() uint8 {
+	status := f.SR1 &^ statusBusy
+	if f.busy() {
+		status |= statusBusy
+	}
+	return status
+}
+
+func (f *Flash) startOperation(d time.Duration) {
+	f.busyUntil = time.Now().Add(d)
+	f.SR1 &^= statusWEL
+}
+
+func (f *Flash) read(addr int) byte {
+	value := f.Memory[addr%len(f.Memory)]
+	if stuck, ok := f.StuckZero[addr%len(f.Memory)]; ok {
+		value &^= stuck
+	}
+	return value
+}
+
+func (f *Flash) address(out []byte) (int, error) {
+	if len(out) < 4 {
+		return 0, fmt.Errorf("command %02x needs an address", out[0])
+	}
+	return (int(out[1])<<16 | int(out[2])<<8 | int(out[3])) % len(f.Memory), nil
+}
+
+/* protected returns true if any part of the given area is write protected */
+func (f *Flash) protected(addr int, length int) bool {
+	bp := int(f.SR1&statusBP) >> 2
+	if bp == 0 {
+		return false
+	}
+
+	size := f.cfg.ProtectUnit << (bp - 1)
+	if size > len(f.Memory) {
+		size = len(f.Memory)
+	}
+
+	return addr+length > len(f.Memory)-size
+}
+
+func (f *Flash) program(addr int, data []byte) {
+	f.ProgramCount++
+
+	if !f.writeAllowed() {
+		return
+	}
+	f.startOperation(f.cfg.ProgramTime)
+
+	if f.protected(addr, 1) || f.FailPrograms > 0 {
+		if f.FailPrograms > 0 {
+			f.FailPrograms--
+		}
+		f.SR1 |= f.cfg.ErrorBit
+		return
+	}
+	f.SR1 &^= f.cfg.ErrorBit
+
+	/* Data wraps around inside the page, like real chips do */
+	page := addr - addr%f.cfg.PageSize
+	offset := addr - page
+	for _, m := range data {
+		f.Memory[page+offset] &= m
+		offset = (offset + 1) % f.cfg.PageSize
+	}
+}
+
+func (f *Flash) erase(addr int, size int, d time.Duration) {
+	f.EraseCount++
+
+	if !f.writeAllowed() {
+		return
+	}
+	f.startOperation(d)
+
+	addr -= addr % size
+	if f.protected(addr, size) || f.FailErases > 0 {
+		if f.FailErases > 0 {
+			f.FailErases--
+		}
+		f.SR1 |= f.cfg.ErrorBit
+		return
+	}
+	f.SR1 &^= f.cfg.ErrorBit
+
+	for i := addr; i < addr+size; i++ {
+		f.Memory[i] = 0xff
+	}
+}
+
+func (f *Flash) writeAllowed() bool {
+	return !f.busy() && f.SR1&statusWEL > 0
+}
+
+func (f *Flash) writeStatus(out []byte) {
+	if !f.writeAllowed() || (f.WPLow && f.SR1&statusSRWD > 0) {
+		return
+	}
+	f.startOperation(f.cfg.ProgramTime)
+
+	if len(out) > 1 {
+		f.SR1 = f.SR1&3 | out[1]&^3
+	}
+	if len(out) > 2 {
+		/* The lock bits are one time programmable */
+		f.SR2 = out[2] | f.SR2&status2LB
+	}
+}
+
+func (f *Flash) securityRegister(out []byte) ([]byte, int, bool) {
+	if len(out) < 4 {
+		return nil, 0, false
+	}
+
+	addr := int(out[1])<<16 | int(out[2])<<8 | int(out[3])
+	index := addr>>12 - 1
+	if index < 0 || index >= len(f.Security) {
+		return nil, 0, false
+	}
+
+	return f.Security[index], addr & 0xfff % f.cfg.SecurityRegisterSize, f.SR2&(1<<(3+index)) > 0
+}
+
+/* SPI executes one transaction, it can be passed to spiflash.New */
+func (f *Flash) SPI(out []byte, in []byte) error {
+	if len(out) == 0 {
+		return errors.New("empty transaction")
+	}
+
+	f.Commands++
+
+	/* A busy chip only answers status reads */
+	if f.busy() && out[0] != 0x05 && out[0] != 0x35 {
+		for i := range in {
+			in[i] = 0xff
+		}
+		return nil
+	}
+
+	switch out[0] {
+	case 0x9F:
+		for i := range in {
+			in[i] = 0
+			if i < len(f.cfg.JEDECID) {
+				in[i] = f.cfg.JEDECID[i]
+			}
+		}
+
+	case 0x05:
+		f.StatusPolls++
+		for i := range in {
+			in[i] = f.status()
+		}
+
+	case 0x35:
+		for i := range in {
+			in[i] = f.SR2
+		}
+
+	case 0x06:
+		f.SR1 |= statusWEL
+
+	case 0x04:
+		f.SR1 &^= statusWEL
+
+	case 0x01:
+		f.writeStatus(out)
+
+	case 0x03:
+		addr, err := f.address(out)
+		if err != nil {
+			return err
+		}
+		for i := range in {
+			in[i] = f.read(addr + i)
+		}
+
+	case 0x5A:
+		addr, err := f.address(out)
+		if err != nil {
+			return err
+		}
+		for i := range in {
+			in[i] = 0xff
+			if addr+i < len(f.cfg.SFDP) {
+				in[i] = f.cfg.SFDP[addr+i]
+			}
+		}
+
+	case 0x02:
+		addr, err := f.address(out)
+		if err != nil {
+			return err
+		}
+		f.program(addr, out[4:])
+
+	case 0x81, 0x20, 0x52, 0xD8:
+		addr, err := f.address(out)
+		if err != nil {
+			return err
+		}
+
+		size := map[byte]int{0x81: f.cfg.PageSize, 0x20: 4096, 0x52: 32 * 1024, 0xD8: 64 * 1024}[out[0]]
+		if size > len(f.Memory) {
+			size = len(f.Memory)
+		}
+		f.erase(addr, size, f.cfg.EraseTime)
+
+	case 0x4B:
+		for i := range in {
+			in[i] = 0xff
+			if i < len(f.cfg.UniqueID) && len(out) == 5 {
+				in[i] = f.cfg.UniqueID[i]
+			}
+		}
+
+	case 0x48:
+		reg, offset, _ := f.securityRegister(out)
+		for i := range in {
+			in[i] = 0xff
+			if reg != nil && offset+i < len(reg) && len(out) == 5 {
+				in[i] = reg[offset+i]
+			}
+		}
+
+	case 0x42:
+		reg, offset, locked := f.securityRegister(out)
+		if reg == nil || !f.writeAllowed() {
+			break
+		}
+		f.startOperation(f.cfg.ProgramTime)
+		for i, m := range out[4:] {
+			if !locked && offset+i < len(reg) {
+				reg[offset+i] &= m
+			}
+		}
+
+	case 0x44:
+		reg, _, locked := f.securityRegister(out)
+		if reg == nil || !f.writeAllowed() {
+			break
+		}
+		f.startOperation(f.cfg.EraseTime)
+		for i := range reg {
+			if !locked {
+				reg[i] = 0xff
+			}
+		}
+
+	case 0x60, 0xC7:
+		f.erase(0, len(f.Memory), f.cfg.ChipEraseTime)
+
+	default:
+		return ErrorUnknownCommand
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package spiflash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* Chips from the same vendor usually implement the unique ID and security registers in the same way */
+type securityFamily struct {
+	name string
+
+	uniqueIDLength int
+	uniqueIDDummy  int
+
+	/* Addresses of the security registers, the lock bits are in status register 2 */
+	registers    []uint32
+	registerSize uint32
+	lockShift    uint8
+}
+
+var securityFamilies = map[string]*securityFamily{
+	"winbond": {name: "winbond", uniqueIDLength: 8, uniqueIDDummy: 4, registers: []uint32{0x1000, 0x2000, 0x3000}, registerSize: 256, lockShift: 3},
+	"puya":    {name: "puya", uniqueIDLength: 16, uniqueIDDummy: 4, registers: []uint32{0x1000, 0x2000, 0x3000}, registerSize: 512, lockShift: 3},
+
+	/* Only supports reading the unique ID */
+	"uid64": {name: "uid64", uniqueIDLength: 8, uniqueIDDummy: 4},
+}
+
+var (
+	ErrorNotSupported = errors.New("operation not supported by this flash")
+
+	/* The ID must be read in one transaction, it has no address that could be used to split it */
+	ErrorUniqueIDTooLong = errors.New("the unique ID does not fit in one SPI transaction")
+)
+
+func (f *Flash) UniqueID() ([]byte, error) {
+	sec := f.device.security
+	if sec == nil || sec.uniqueIDLength == 0 {
+		return nil, ErrorNotSupported
+	}
+
+	if n := 1 + sec.uniqueIDDummy + sec.uniqueIDLength; n > f.maxBytesPerTransaction {
+		return nil, fmt.Errorf("%w: it needs %d bytes, the interface handles %d", ErrorUniqueIDTooLong, n, f.maxBytesPerTransaction)
+	}
+
+	out := make([]byte, 1+sec.uniqueIDDummy)
+	out[0] = 0x4B
+
+	id := make([]byte, sec.uniqueIDLength)
+	if err := f.spi(out, id); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (f *Flash) SecurityRegisterCount() int {
+	if f.device.security == nil {
+		return 0
+	}
+	return len(f.device.security.registers)
+}
+
+func (f *Flash) SecurityRegisterSize() uint32 {
+	if f.device.security == nil {
+		return 0
+	}
+	return f.device.security.registerSize
+}
+
+func (f *Flash) securityAddress(index int, offset uint32, length int) (uint32, error) {
+	if index < 0 || index >= f.SecurityRegisterCount() {
+		return 0, ErrorNotSupported
+	}
+
+	if uint64(offset)+uint64(length) > uint64(f.device.security.registerSize) {
+		return 0, ErrorOutOfRange
+	}
+
+	return f.device.security.registers[index] + offset, nil
+}
+
+func (f *Flash) SecurityRead(index int, offset uint32, data []byte) (int, error) {
+	addr, err := f.securityAddress(index, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	return completeIO(addr, data, func(offset uint32, data []byte) (int, error) {
+		/* Command, 24-bit address and one dummy byte */
+		if len(data)+5 > f.maxBytesPerTransaction {
+			data = data[:f.maxBytesPerTransaction-5]
+		}
+
+		var out [5]byte
+		binary.BigEndian.PutUint32(out[:], offset)
+		out[0] = 0x48
+
+		if err := f.spi(out[:], data); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	})
+}
+
+func (f *Flash) SecurityProgram(index int, offset uint32, data []byte) (int, error) {
+	addr, err := f.securityAddress(index, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	return completeIO(addr, data, func(offset uint32, data []byte) (int, error) {
+		maxLen := pageCrossLength(offset, uint32(len(data)), f.device.pageSize)
+		if len(data) > maxLen {
+			data = data[:maxLen]
+		}
+		if len(data)+4 > f.maxBytesPerTransaction {
+			data = data[:f.maxBytesPerTransaction-4]
+		}
+
+		cmd := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(cmd, offset)
+		cmd[0] = 0x42
+		cmd = append(cmd, data...)
+
+		if err := f.writeEnable(); err != nil {
+			return 0, err
+		}
+		if err := f.spi(cmd, nil); err != nil {
+			return 0, err
+		}
+		if err := f.waitIdle(time.Second); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	})
+}
+
+func (f *Flash) SecurityErase(index int) error {
+	addr, err := f.securityAddress(index, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := f.writeEnable(); err != nil {
+		return err
+	}
+
+	var cmd [4]byte
+	binary.BigEndian.PutUint32(cmd[:], addr)
+	cmd[0] = 0x44
+
+	if err := f.spi(cmd[:], nil); err != nil {
+		return err
+	}
+
+	return f.waitIdle(time.Second)
+}
+
+func (f *Flash) SecurityLocked(index int) (bool, error) {
+	if _, err := f.securityAddress(index, 0, 0); err != nil {
+		return false, err
+	}
+
+	s, err := f.StatusRead()
+	if err != nil {
+		return false, err
+	}
+
+	return s.SR2&(1<<(f.device.security.lockShift+uint8(index))) > 0, nil
+}
+
+/* SecurityLock makes a security register read-only. This is permanent, it cannot be undone! */
+func (f *Flash) SecurityLock(index int) error {
+	if _, err := f.securityAddress(index, 0, 0); err != nil {
+		return err
+	}
+
+	s, err := f.StatusRead()
+	if err != nil {
+		return err
+	}
+	if !s.HasSR2 {
+		return ErrorNotSupported
+	}
+
+	s.SR1 &^= statusWEL | statusBusy
+	s.SR2 |= 1 << (f.device.security.lockShift + uint8(index))
+	if err := f.statusWrite(s); err != nil {
+		return err
+	}
+
+	if locked, err := f.SecurityLocked(index); err != nil {
+		return err
+	} else if !locked {
+		return ErrorStatusLocked
+	}
+
+	return nil
+}
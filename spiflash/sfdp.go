@@ -0,0 +1,171 @@
+package spiflash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrorNoSFDP = errors.New("flash does not support SFDP")
+
+func (f *Flash) sfdpRead(offset uint32, data []byte) (int, error) {
+	/* Command, 24-bit address and one dummy byte */
+	if len(data)+5 > f.maxBytesPerTransaction {
+		data = data[:f.maxBytesPerTransaction-5]
+	}
+
+	var out [5]byte
+	binary.BigEndian.PutUint32(out[:], offset)
+	out[0] = 0x5A
+
+	if err := f.spi(out[:], data); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+/* sfdpReadBasic returns the DWORDs of the JEDEC basic flash parameter table */
+func (f *Flash) sfdpReadBasic() ([]uint32, error) {
+	var hdr [16]byte
+	if _, err := completeIO(0, hdr[:], f.sfdpRead); err != nil {
+		return nil, err
+	}
+
+	if string(hdr[:4]) != "SFDP" {
+		return nil, ErrorNoSFDP
+	}
+
+	/* The first parameter header always describes the basic table */
+	param := hdr[8:]
+	if param[0] != 0 || param[7] != 0xFF {
+		return nil, ErrorNoSFDP
+	}
+
+	length := int(param[3])
+	if length < 9 {
+		return nil, errors.New("SFDP basic parameter table is too short")
+	}
+	if length > 20 {
+		length = 20
+	}
+
+	ptr := uint32(param[4]) | uint32(param[5])<<8 | uint32(param[6])<<16
+
+	table := make([]byte, 4*length)
+	if _, err := completeIO(ptr, table, f.sfdpRead); err != nil {
+		return nil, err
+	}
+
+	dwords := make([]uint32, length)
+	for i := range dwords {
+		dwords[i] = binary.LittleEndian.Uint32(table[4*i:])
+	}
+
+	return dwords, nil
+}
+
+type sfdpEraseType struct {
+	opcode uint8
+	size   uint32
+}
+
+func sfdpParse(id uint32, dw []uint32) (flashDevice, error) {
+	dev := flashDevice{
+		deviceID: id,
+		name:     fmt.Sprintf("SFDP %08x", id),
+		source:   "SFDP",
+
+		opcodeChipErase:         0xC7,
+		opcodeStatusWriteEnable: 0x06,
+		pageSize:                256,
+	}
+
+	/* Density is given in bits */
+	if dw[1]&(1<<31) == 0 {
+		dev.chipSize = (dw[1] + 1) / 8
+	} else if n := dw[1] &^ (1 << 31); n >= 3 && n < 35 {
+		dev.chipSize = uint32(1 << (n - 3))
+	}
+	if dev.chipSize == 0 {
+		return dev, errors.New("SFDP reports invalid density")
+	}
+
+	/* Volatile status registers need a different write enable opcode */
+	if dw[0]&(1<<3) > 0 {
+		dev.statusVolatile = true
+		if dw[0]&(1<<4) == 0 {
+			dev.opcodeStatusWriteEnable = 0x50
+		}
+	}
+
+	var erase []sfdpEraseType
+	for _, m := range []uint32{dw[7], dw[7] >> 16, dw[8], dw[8] >> 16} {
+		if n := m & 0xFF; n > 0 && n < 32 {
+			erase = append(erase, sfdpEraseType{opcode: uint8(m >> 8), size: 1 << n})
+		}
+	}
+
+	/* Old tables may only describe the 4kB erase */
+	if len(erase) == 0 && dw[0]&3 == 1 {
+		erase = append(erase, sfdpEraseType{opcode: uint8(dw[0] >> 8), size: 4096})
+	}
+	if len(erase) == 0 {
+		return dev, errors.New("SFDP does not describe any erase command")
+	}
+
+	sort.Slice(erase, func(i, j int) bool {
+		return erase[i].size < erase[j].size
+	})
+
+	dev.opcodeBlockErase = erase[0].opcode
+	dev.blockSize = erase[0].size
+	dev.opcodePageErase = erase[len(erase)-1].opcode
+	dev.pageEraseSize = erase[len(erase)-1].size
+
+	/* Chips that keep the quad enable bit in status register 2 can read it with 0x35 */
+	if len(dw) >= 15 {
+		if qer := (dw[14] >> 20) & 7; qer == 4 || qer == 5 {
+			dev.hasStatus2 = true
+		}
+	}
+
+	if len(dw) >= 11 {
+		if n := (dw[10] >> 4) & 0xF; n > 0 {
+			dev.pageSize = 1 << n
+		}
+	}
+
+	return dev, nil
+}
+
+func (f *Flash) sfdpDevice(id uint32) (flashDevice, error) {
+	dw, err := f.sfdpReadBasic()
+	if err != nil {
+		return flashDevice{}, err
+	}
+
+	return sfdpParse(id, dw)
+}
+
+/* sfdpCompare returns a description of every parameter where the table and SFDP differ */
+func sfdpCompare(table flashDevice, sfdp flashDevice) []string {
+	var result []string
+
+	check := func(name string, t uint32, s uint32) {
+		if t != s {
+			result = append(result, fmt.Sprintf("%s: table has %#x, SFDP reports %#x", name, t, s))
+		}
+	}
+
+	check("chip size", table.chipSize, sfdp.chipSize)
+	check("page size", table.pageSize, sfdp.pageSize)
+	if table.blockSize == sfdp.blockSize {
+		check("block erase opcode", uint32(table.opcodeBlockErase), uint32(sfdp.opcodeBlockErase))
+	} else {
+		check("block size", table.blockSize, sfdp.blockSize)
+	}
+
+	return result
+}
@@ -0,0 +1,206 @@
+package spiflash
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	statusBusy = 1 << 0
+	statusWEL  = 1 << 1
+	statusSRWD = 1 << 7
+
+	defaultBPMask      = 0x1c
+	defaultProtectUnit = 64 * 1024
+)
+
+type Status struct {
+	SR1    uint8
+	SR2    uint8
+	HasSR2 bool
+
+	bpMask uint8
+	tbMask uint8
+}
+
+func (s Status) Busy() bool {
+	return s.SR1&statusBusy > 0
+}
+
+func (s Status) WriteEnabled() bool {
+	return s.SR1&statusWEL > 0
+}
+
+/* BlockProtect returns the value of the block protect bits */
+func (s Status) BlockProtect() uint8 {
+	bp := s.SR1 & s.bpMask
+	for mask := s.bpMask; mask > 0 && mask&1 == 0; mask >>= 1 {
+		bp >>= 1
+	}
+	return bp
+}
+
+/* BlockProtectBottom is true if the protected area starts at the bottom of the chip */
+func (s Status) BlockProtectBottom() bool {
+	return s.SR1&s.tbMask > 0
+}
+
+/* WriteDisabled is true if the status register cannot be written while the WP pin is low */
+func (s Status) WriteDisabled() bool {
+	return s.SR1&statusSRWD > 0
+}
+
+func (s Status) String() string {
+	result := fmt.Sprintf("SR1=%02x", s.SR1)
+	if s.HasSR2 {
+		result += fmt.Sprintf(" SR2=%02x", s.SR2)
+	}
+
+	flag := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	result += fmt.Sprintf(" (BUSY=%d WEL=%d BP=%d", flag(s.Busy()), flag(s.WriteEnabled()), s.BlockProtect())
+	if s.tbMask != 0 {
+		result += fmt.Sprintf(" TB=%d", flag(s.BlockProtectBottom()))
+	}
+	return result + fmt.Sprintf(" SRWD=%d)", flag(s.WriteDisabled()))
+}
+
+func (d flashDevice) bpMask() uint8 {
+	if d.statusBPMask == 0 {
+		return defaultBPMask
+	}
+	return d.statusBPMask
+}
+
+/* Chips with a TB bit in position 5 do not report program errors there */
+func (d flashDevice) statusErrorMask() uint8 {
+	if d.statusTBMask&(1<<5) > 0 {
+		return 0
+	}
+	return 1 << 5
+}
+
+func (f *Flash) StatusRead() (Status, error) {
+	s := Status{
+		bpMask: f.device.bpMask(),
+		tbMask: f.device.statusTBMask,
+	}
+
+	var err error
+	if s.SR1, err = f.statusRead(); err != nil {
+		return s, err
+	}
+
+	if f.device.hasStatus2 {
+		var result [1]byte
+		if err := f.spi([]byte{0x35}, result[:]); err != nil {
+			return s, err
+		}
+		s.SR2 = result[0]
+		s.HasSR2 = true
+	}
+
+	return s, nil
+}
+
+func (f *Flash) statusWrite(s Status) error {
+	writeEnable := f.device.opcodeStatusWriteEnable
+	if writeEnable == 0 {
+		writeEnable = 0x06
+	}
+
+	if err := f.spi([]byte{writeEnable}, nil); err != nil {
+		return err
+	}
+
+	cmd := []byte{0x01, s.SR1}
+	if s.HasSR2 {
+		cmd = append(cmd, s.SR2)
+	}
+
+	if err := f.spi(cmd, nil); err != nil {
+		return err
+	}
+
+	return f.waitIdle(time.Second)
+}
+
+var ErrorStatusLocked = errors.New("status register is locked, check the WP pin")
+
+/* SetProtection writes the block protect bits and the status register write disable bit */
+func (f *Flash) SetProtection(bp uint8, srwd bool) error {
+	s, err := f.StatusRead()
+	if err != nil {
+		return err
+	}
+
+	value := uint16(bp)
+	for mask := s.bpMask; mask > 0 && mask&1 == 0; mask >>= 1 {
+		value <<= 1
+	}
+	if value&^uint16(s.bpMask) != 0 {
+		return fmt.Errorf("block protect value %d is not valid for this chip", bp)
+	}
+
+	s.SR1 &^= s.bpMask | statusSRWD | statusWEL | statusBusy
+	s.SR1 |= uint8(value)
+	if srwd {
+		s.SR1 |= statusSRWD
+	}
+
+	if err := f.statusWrite(s); err != nil {
+		return err
+	}
+
+	check, err := f.StatusRead()
+	if err != nil {
+		return err
+	}
+	if check.SR1&(s.bpMask|statusSRWD) != s.SR1&(s.bpMask|statusSRWD) {
+		return ErrorStatusLocked
+	}
+
+	return nil
+}
+
+/* Protect sets all block protect bits, making the whole chip read-only */
+func (f *Flash) Protect(srwd bool) error {
+	bp := f.device.bpMask()
+	for bp&1 == 0 {
+		bp >>= 1
+	}
+	return f.SetProtection(bp, srwd)
+}
+
+func (f *Flash) Unprotect() error {
+	return f.SetProtection(0, false)
+}
+
+/* ProtectedRange returns the area of the chip that cannot be written with the given status */
+func (f *Flash) ProtectedRange(s Status) (uint32, uint32) {
+	bp := s.BlockProtect()
+	if bp == 0 {
+		return 0, 0
+	}
+
+	unit := f.device.protectUnit
+	if unit == 0 {
+		unit = defaultProtectUnit
+	}
+
+	length := f.device.chipSize
+	if bp < 32 && uint64(unit)<<(bp-1) < uint64(length) {
+		length = unit << (bp - 1)
+	}
+
+	if s.BlockProtectBottom() {
+		return 0, length
+	}
+	return f.device.chipSize - length, length
+}
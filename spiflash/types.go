@@ -2,41 +2,79 @@ package spiflash
 
 type flashDevice struct {
 	deviceID uint32
+	mask     uint32
 	name     string
+	source   string
 
 	opcodeChipErase  uint8
 	opcodeBlockErase uint8
 	opcodePageErase  uint8
 
-	blockSize uint32
-	pageSize  uint32
-	chipSize  uint32
+	blockSize     uint32
+	pageSize      uint32
+	pageEraseSize uint32
+	chipSize      uint32
+
+	/* Status register behaviour, the zero value means non-volatile bits written after 0x06 */
+	statusVolatile          bool
+	opcodeStatusWriteEnable uint8
+	hasStatus2              bool
+
+	/* Block protection, the zero values mean BP0-BP2 protecting 64kB, 128kB, ... from the top */
+	statusBPMask uint8
+	statusTBMask uint8
+	protectUnit  uint32
+
+	/* Unique ID and security registers, nil if not supported */
+	security *securityFamily
 }
 
 var devices = []flashDevice{
-	{deviceID: 0x1f65, name: "Adesto AT25DN512", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageSize: 256, chipSize: 64 * 1024},
-	{deviceID: 0xef3012, name: "Winbond W25X20", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageSize: 256, chipSize: 256 * 1024},
-	{deviceID: 0x0e4012, name: "Freemont FT25H02", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageSize: 256, chipSize: 256 * 1024},
-	{deviceID: 0x0e4013, name: "Freemont FT25H04", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageSize: 256, chipSize: 512 * 1024},
-	{deviceID: 0xa13111a1, name: "Fudan Microelectronics FM25F01", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageSize: 256, chipSize: 128 * 1024},
-	{deviceID: 0x85401285, name: "PUYA P25Q21H", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageSize: 256, chipSize: 256 * 1024},
-	{deviceID: 0x85601385, name: "PUYA P25D40H", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageSize: 256, chipSize: 512 * 1024},
+	{deviceID: 0x1f65, name: "Adesto AT25DN512", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageEraseSize: 256, pageSize: 256, chipSize: 64 * 1024, statusBPMask: 0x0c, protectUnit: 64 * 1024},
+	{deviceID: 0xef3012, name: "Winbond W25X20", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageEraseSize: 64 * 1024, pageSize: 256, chipSize: 256 * 1024, statusTBMask: 0x20, security: securityFamilies["uid64"]},
+	{deviceID: 0x0e4012, name: "Freemont FT25H02", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageEraseSize: 64 * 1024, pageSize: 256, chipSize: 256 * 1024},
+	{deviceID: 0x0e4013, name: "Freemont FT25H04", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageEraseSize: 64 * 1024, pageSize: 256, chipSize: 512 * 1024},
+	{deviceID: 0xa13111a1, name: "Fudan Microelectronics FM25F01", opcodeChipErase: 0xC7, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0xD8, pageEraseSize: 64 * 1024, pageSize: 256, chipSize: 128 * 1024, security: securityFamilies["uid64"]},
+	{deviceID: 0x85401285, name: "PUYA P25Q21H", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageEraseSize: 256, pageSize: 256, chipSize: 256 * 1024, hasStatus2: true, security: securityFamilies["puya"]},
+	{deviceID: 0x85601385, name: "PUYA P25D40H", opcodeChipErase: 0x60, opcodeBlockErase: 0x20, blockSize: 4096, opcodePageErase: 0x81, pageEraseSize: 256, pageSize: 256, chipSize: 512 * 1024, hasStatus2: true, security: securityFamilies["puya"]},
+}
+
+/* Size erased by the page erase opcode, guessed from the opcode if it is not given */
+func (d flashDevice) pageEraseBytes() uint32 {
+	if d.pageEraseSize > 0 {
+		return d.pageEraseSize
+	}
+
+	switch d.opcodePageErase {
+	case 0x81:
+		return d.pageSize
+	case 0x52:
+		return 32 * 1024
+	case 0xD8:
+		return 64 * 1024
+	}
+	return d.blockSize
 }
 
-func rightAlign(in uint32) (uint32, uint32) {
+func rightAlign(in uint32, inMask uint32) (uint32, uint32) {
 	mask := uint32(0)
 
 	for (in >> 24) == 0 {
 		in <<= 8
+		inMask <<= 8
 		mask <<= 8
 		mask |= 0xFF
 	}
+
+	if inMask != 0 {
+		return in & inMask, ^mask & inMask
+	}
 	return in, ^mask
 }
 
 func deviceLookup(id uint32) (flashDevice, bool) {
 	for _, m := range devices {
-		compare, mask := rightAlign(m.deviceID)
+		compare, mask := rightAlign(m.deviceID, m.mask)
 
 		if id&mask == compare {
 			return m, true
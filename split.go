@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/BertoldVdb/jms578flash/image"
+)
+
+const (
+	partCode     = "code.bin"
+	partNVRAM    = "nvram.bin"
+	partMetadata = "metadata.json"
+)
+
+func runSplit(firmware string, dir string) {
+	fw, err := os.ReadFile(firmware)
+	if err != nil {
+		log.Fatalln("Failed to read firmware:", err)
+	}
+
+	code, nvram, meta, err := image.Split(fw)
+	if err != nil {
+		log.Fatalln("Failed to split firmware:", err)
+	}
+
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		log.Fatalln("Failed to encode metadata:", err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalln("Failed to create directory:", err)
+	}
+
+	files := map[string][]byte{
+		partCode:     code,
+		partMetadata: append(metaJSON, '\n'),
+	}
+	if meta.Type == "flash" {
+		files[partNVRAM] = nvram
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			log.Fatalln("Failed to write to file:", err)
+		}
+		log.Println(len(data), "bytes written to", path)
+	}
+}
+
+func runJoin(dir string, firmware string) {
+	code, err := os.ReadFile(filepath.Join(dir, partCode))
+	if err != nil {
+		log.Fatalln("Failed to read code:", err)
+	}
+
+	metaJSON, err := os.ReadFile(filepath.Join(dir, partMetadata))
+	if err != nil {
+		log.Fatalln("Failed to read metadata:", err)
+	}
+
+	var meta image.Metadata
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		log.Fatalln("Failed to parse metadata:", err)
+	}
+
+	var nvram []byte
+	if meta.Type == "flash" {
+		nvram, err = os.ReadFile(filepath.Join(dir, partNVRAM))
+		if err != nil {
+			log.Fatalln("Failed to read NVRAM:", err)
+		}
+	}
+
+	fw, err := image.Join(code, nvram, &meta)
+	if err != nil {
+		log.Fatalln("Failed to join firmware:", err)
+	}
+
+	if err := os.WriteFile(firmware, fw, 0644); err != nil {
+		log.Fatalln("Failed to write to file:", err)
+	}
+	log.Println(len(fw), "bytes written to", firmware)
+}